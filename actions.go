@@ -0,0 +1,137 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The actions every install knows.  The catalog in config.json can change these and add
+// more, and a slacker can change them again for its own posts.
+var DEFAULT_ACTIONS = map[string]ActionDef{
+	"error": {
+		IconURL:  "https://s3.amazonaws.com/centric-slack/cbot-error.png",
+		Color:    "danger",
+		Priority: "urgent",
+	},
+	"info": {
+		IconURL:  "https://s3.amazonaws.com/centric-slack/cbot-info.png",
+		Color:    "#439FE0",
+		Priority: "low",
+	},
+	"success": {
+		IconURL:  "https://s3.amazonaws.com/centric-slack/cbot-success.png",
+		Color:    "good",
+		Priority: "normal",
+	},
+	"warn": {
+		IconURL:  "https://s3.amazonaws.com/centric-slack/cbot-warning.png",
+		Color:    "warning",
+		Priority: "high",
+	},
+}
+
+// The longest prefix an action can put in front of the text.  Anything longer would eat
+// into the room for the text itself.
+const MAX_PREFIX_LENGTH = 100
+
+var actionName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ActionDef is how posts for an action look, and how soon they go.  Anything left out
+// comes from the catalog underneath: a slacker's actions sit over config.json's, which
+// sit over the defaults.
+type ActionDef struct {
+	IconURL   string `json:"icon_url"`
+	IconEmoji string `json:"icon_emoji"` // for example :rocket:
+	Color     string `json:"color"`      // for attachments, good, warning, danger or #RRGGBB
+	Priority  string `json:"priority"`   // low, normal, high or urgent, defaults normal
+	Prefix    string `json:"prefix"`     // goes in front of the text
+}
+
+// over lays the settings that are filled in on top of the action.
+func (def ActionDef) over(top ActionDef) ActionDef {
+	if top.IconURL != "" {
+		def.IconURL = top.IconURL
+	}
+	if top.IconEmoji != "" {
+		def.IconEmoji = top.IconEmoji
+	}
+	if top.Color != "" {
+		def.Color = top.Color
+	}
+	if top.Priority != "" {
+		def.Priority = top.Priority
+	}
+	if top.Prefix != "" {
+		def.Prefix = top.Prefix
+	}
+	return def
+} // func
+
+// ActionPriority ranks a message by its action, which picks its lane unless the caller
+// asked for a priority.  Bigger is more important.
+func ActionPriority(action string, scfg SlackConfig) int {
+	priority := LookupAction(action, scfg).Priority
+	for p, name := range PRIORITY_NAMES {
+		if strings.EqualFold(priority, name) {
+			return p
+		}
+	} // for
+	return PRIORITY_NORMAL
+} // func
+
+// KnownAction tells the caller if the action is in the slacker's catalog.  Leaving the
+// action out is fine too.
+func KnownAction(action string, scfg SlackConfig) bool {
+	if action == "" {
+		return true
+	}
+	if _, ok := scfg.Actions[action]; ok {
+		return true
+	}
+	if _, ok := appConfig.Actions[action]; ok {
+		return true
+	}
+	_, ok := DEFAULT_ACTIONS[action]
+	return ok
+} // func
+
+// LookupAction puts together the slacker's settings for the action.  The slacker's old
+// colors setting still wins for the color.
+func LookupAction(action string, scfg SlackConfig) ActionDef {
+	def := DEFAULT_ACTIONS[action].over(appConfig.Actions[action]).over(scfg.Actions[action])
+	if color, ok := scfg.Colors[action]; ok {
+		def.Color = color
+	}
+	return def
+} // func
+
+// ValidateActions returns what is wrong with a catalog of actions, if anything.
+func ValidateActions(actions map[string]ActionDef) string {
+	for name, def := range actions {
+		if !actionName.MatchString(name) {
+			return "Action names may only use letters, digits, - and _."
+		}
+		if def.Color != "" && !ValidColor(def.Color) {
+			return "The " + name + " color must be good, warning, danger or #RRGGBB."
+		}
+		if def.Priority != "" && !validLane(def.Priority) {
+			return "The " + name + " priority must be low, normal, high or urgent."
+		}
+		if utf8.RuneCountInString(def.Prefix) > MAX_PREFIX_LENGTH {
+			return "The " + name + " prefix can't be longer than " + strconv.Itoa(MAX_PREFIX_LENGTH) + " characters."
+		}
+	} // for
+	return ""
+} // func
+
+// validLane tells the caller if the priority names one of the lanes.
+func validLane(priority string) bool {
+	for _, name := range PRIORITY_NAMES {
+		if strings.EqualFold(priority, name) {
+			return true
+		}
+	} // for
+	return false
+} // func
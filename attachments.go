@@ -0,0 +1,81 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// Slack shows no more than this many attachments on a post.
+const MAX_ATTACHMENTS = 20
+
+var hexColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// Attachment is a block of structured content shown under the text of a post.
+type Attachment struct {
+	Fallback  string            `json:"fallback"` // plain text for notifications, defaults to the title
+	Color     string            `json:"color"`    // good, warning, danger or #RRGGBB, defaults by action
+	Title     string            `json:"title"`
+	TitleLink string            `json:"title_link"`
+	Text      string            `json:"text"`
+	Fields    []AttachmentField `json:"fields"`
+	Footer    string            `json:"footer"`
+	Timestamp int64             `json:"ts"` // seconds since the epoch
+}
+
+// AttachmentField is a title and value pair.  Short fields sit side by side.
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// BuildAttachments readies the message's attachments for Slack, filling in the color
+// and fallback text where the sender left them out.
+func BuildAttachments(doc SlackMessageIn, scfg SlackConfig) []Attachment {
+	if len(doc.Attachments) == 0 {
+		return nil
+	}
+	list := make([]Attachment, len(doc.Attachments))
+	for i, att := range doc.Attachments {
+		if att.Color == "" {
+			att.Color = LookupAction(doc.Action, scfg).Color
+		}
+		if att.Fallback == "" {
+			att.Fallback = att.Title
+		}
+		if att.Fallback == "" {
+			att.Fallback = att.Text
+		}
+		list[i] = att
+	} // for
+	return list
+} // func
+
+// ValidateAttachments returns what is wrong with the attachments, if anything.
+func ValidateAttachments(list []Attachment) string {
+	if len(list) > MAX_ATTACHMENTS {
+		return "No more than " + strconv.Itoa(MAX_ATTACHMENTS) + " attachments are allowed."
+	}
+	for i, att := range list {
+		n := strconv.Itoa(i + 1)
+		if att.Title == "" && att.Text == "" && len(att.Fields) == 0 {
+			return "Attachment " + n + " needs a title, text or fields."
+		}
+		if att.Color != "" && !ValidColor(att.Color) {
+			return "Attachment " + n + " color must be good, warning, danger or #RRGGBB."
+		}
+		if att.TitleLink != "" && att.Title == "" {
+			return "Attachment " + n + " has a title_link but no title."
+		}
+	} // for
+	return ""
+} // func
+
+// ValidColor tells the caller if Slack will understand the color.
+func ValidColor(color string) bool {
+	switch color {
+	case "good", "warning", "danger":
+		return true
+	}
+	return hexColor.MatchString(color)
+} // func
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// What to do with a message when the outbound list is full.
+const (
+	POLICY_BLOCK = "block" // hold it until there is room, backing up only its own worker
+	POLICY_SHED  = "shed"  // dead letter the least important message
+	POLICY_SPILL = "spill" // write it to disk until there is room
+)
+
+// Queue defaults used when config.json does not override them.
+const (
+	DEFAULT_INBOUND_CAPACITY  = 100
+	DEFAULT_OUTBOUND_CAPACITY = 100
+	MAX_RETRY_AFTER           = 60
+)
+
+var (
+	inboundDrain = &DrainMeter{}
+	spillFile    string
+)
+
+// spilledPosts are a worker's posts waiting on disk under the spill policy.  Each worker
+// has a file of its own, so a backed up hook only holds up the hooks on its own worker.
+type spilledPosts struct {
+	lock   sync.Mutex
+	file   string
+	count  int
+	offset int64 // where the oldest post still on disk starts
+}
+
+// DrainMeter keeps a running estimate of how many messages per second are being
+// taken off a list.
+type DrainMeter struct {
+	lock  sync.Mutex
+	rate  float64
+	count int
+	since time.Time
+}
+
+// Mark records that n messages were just taken off the list.
+func (d *DrainMeter) Mark(n int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	if d.since.IsZero() {
+		d.since = now
+	}
+	d.count += n
+	elapsed := now.Sub(d.since).Seconds()
+	if elapsed < 1 {
+		return
+	}
+	// Smooth things out so one slow second doesn't swing the estimate too far.
+	sample := float64(d.count) / elapsed
+	if d.rate == 0 {
+		d.rate = sample
+	} else {
+		d.rate = 0.7*d.rate + 0.3*sample
+	}
+	d.count = 0
+	d.since = now
+} // func
+
+// RetryAfter estimates how many seconds it will take to work through the given number
+// of queued messages.
+func (d *DrainMeter) RetryAfter(queued int) int {
+	d.lock.Lock()
+	rate := d.rate
+	d.lock.Unlock()
+	if rate <= 0 {
+		return MAX_RETRY_AFTER
+	}
+	secs := int(math.Ceil(float64(queued) / rate))
+	if secs < 1 {
+		return 1
+	}
+	if secs > MAX_RETRY_AFTER {
+		return MAX_RETRY_AFTER
+	}
+	return secs
+} // func
+
+// QueueOutbound puts a message on the outbound list, following the configured policy
+// if the list is full.  A message that can't be queued ends up as a dead letter.
+func QueueOutbound(smo SlackMessageOut) {
+	switch appConfig.OutboundFullPolicy {
+	case POLICY_SHED:
+		if !FillOutboundList(smo) {
+			ShedOutbound(smo)
+		}
+	case POLICY_SPILL:
+		// Once something has spilled, everything behind it on the same worker spills
+		// too.  Otherwise a hook's messages could get out of order.
+		lanes := OutboundList[ShardFor(smo.Hook)]
+		if lanes.Spilled() == 0 && lanes.Put(smo) {
+			return
+		}
+		if err := lanes.Spill(smo); err != nil {
+			log.Printf("error: Could not spill to disk/%s", err.Error())
+			AddDeadLetter("Outbound list is full", smo.Key, nil, &smo)
+		}
+	default:
+		HoldOutboundList(smo)
+	} // switch
+} // func
+
+// ShedOutbound makes room for a message whose lane is full.  The oldest message in the
+// least important lane below it is dead lettered and the new one takes its place.  If
+// there is nothing less important, the new message is the one dead lettered, so among
+// equals the oldest messages keep their place.
+func ShedOutbound(smo SlackMessageOut) {
+	lanes := OutboundList[ShardFor(smo.Hook)]
+	if victim, ok := lanes.Evict(MessagePriority(smo.Priority, smo.Action, smo.Key)); ok {
+		shedMessage(victim)
+		if lanes.Force(smo) {
+			return
+		}
+	}
+	shedMessage(smo)
+} // func
+
+// shedMessage dead letters a message that lost its place on the outbound list.
+func shedMessage(smo SlackMessageOut) {
+	log.Printf("warn: Shed %s message %s from the outbound list", smo.Action, smo.Id)
+	AddDeadLetter("Shed from full outbound list", smo.Key, nil, &smo)
+} // func
+
+// RefillFromSpill moves spilled posts back onto every worker's list for as long as
+// there is room.
+func RefillFromSpill() {
+	for _, lanes := range OutboundList {
+		lanes.Refill()
+	} // for
+} // func
+
+// ResetSpill clears out the spill files from the last run.  Anything in them is still
+// unfinished in the queue log, which is what gets replayed.
+func ResetSpill() {
+	for _, lanes := range OutboundList {
+		lanes.resetSpill()
+	} // for
+} // func
+
+// Refill moves spilled posts back onto the list, oldest first, for as long as there is
+// room.
+func (ol OutboundLanes) Refill() {
+	ol.spill.lock.Lock()
+	defer ol.spill.lock.Unlock()
+	if ol.spill.count == 0 {
+		return
+	}
+
+	file, err := os.Open(ol.spill.file)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err = file.Seek(ol.spill.offset, io.SeekStart); err != nil {
+		log.Printf("error: Could not seek in spill file/%s", err.Error())
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	for ol.spill.count > 0 {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			log.Printf("error: Could not read spill file/%s", err.Error())
+			return
+		}
+		var doc SlackMessageOut
+		if err = json.Unmarshal(line, &doc); err != nil {
+			log.Printf("error: Could not decode spilled message/%s", err.Error())
+		} else if !ol.Put(doc) {
+			return
+		}
+		ol.spill.offset += int64(len(line))
+		ol.spill.count--
+	} // for
+
+	// Everything is back on the list, so start the file over.
+	ol.spill.offset = 0
+	if err = os.Truncate(ol.spill.file, 0); err != nil {
+		log.Printf("error: Could not truncate spill file/%s", err.Error())
+	}
+} // func
+
+// Spill appends the post to the worker's spill file.
+func (ol OutboundLanes) Spill(smo SlackMessageOut) error {
+	buf, err := json.Marshal(smo)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	ol.spill.lock.Lock()
+	defer ol.spill.lock.Unlock()
+	file, err := os.OpenFile(ol.spill.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(buf); err != nil {
+		return err
+	}
+	ol.spill.count++
+	return nil
+} // func
+
+// Spilled counts the posts waiting in the worker's spill file.
+func (ol OutboundLanes) Spilled() int {
+	ol.spill.lock.Lock()
+	defer ol.spill.lock.Unlock()
+	return ol.spill.count
+} // func
+
+// resetSpill removes the worker's spill file.
+func (ol OutboundLanes) resetSpill() {
+	ol.spill.lock.Lock()
+	defer ol.spill.lock.Unlock()
+	if err := os.Remove(ol.spill.file); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: Could not remove spill file/%s", err.Error())
+	}
+	ol.spill.count = 0
+	ol.spill.offset = 0
+} // func
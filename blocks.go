@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Block Kit limits, as documented by Slack.
+const (
+	MAX_BLOCKS            = 50
+	MAX_BLOCK_ID          = 255
+	MAX_SECTION_TEXT      = 3000
+	MAX_SECTION_FIELDS    = 10
+	MAX_FIELD_TEXT        = 2000
+	MAX_HEADER_TEXT       = 150
+	MAX_IMAGE_URL         = 3000
+	MAX_ALT_TEXT          = 2000
+	MAX_CONTEXT_ELEMENTS  = 10
+	MAX_ACTIONS_ELEMENTS  = 25
+	MAX_BUTTON_TEXT       = 75
+	MAX_ACTION_ID         = 255
+	MAX_BUTTON_VALUE      = 2000
+	MAX_PLACEHOLDER_TEXT  = 150
+	MAX_SELECT_OPTIONS    = 100
+	MAX_OPTION_TEXT       = 75
+	MAX_OPTION_VALUE      = 150
+	MAX_OVERFLOW_OPTIONS  = 5
+	MAX_CHECKBOX_OPTIONS  = 10
+	MAX_VIDEO_TITLE       = 200
+	MAX_VIDEO_DESCRIPTION = 200
+)
+
+// A Block Kit object decoded just far enough to check it over.
+type blockObject map[string]interface{}
+
+// BlocksText pulls the first bit of readable text out of the blocks.  Slack wants
+// plain text alongside blocks for notifications, and digests need a line to show.
+func BlocksText(blocks []json.RawMessage) string {
+	for _, raw := range blocks {
+		var block blockObject
+		if json.Unmarshal(raw, &block) != nil {
+			continue
+		}
+		if text, ok := block["text"].(map[string]interface{}); ok {
+			if s, _ := text["text"].(string); s != "" {
+				return s
+			}
+		}
+	} // for
+	return ""
+} // func
+
+// ValidateBlocks checks the blocks against the Block Kit rules for messages.  It
+// returns what is wrong, and where, if anything.
+func ValidateBlocks(blocks []json.RawMessage) string {
+	if len(blocks) > MAX_BLOCKS {
+		return fmt.Sprintf("No more than %d blocks are allowed.", MAX_BLOCKS)
+	}
+	ids := make(map[string]bool)
+	for i, raw := range blocks {
+		path := fmt.Sprintf("blocks[%d]", i)
+		var block blockObject
+		if err := json.Unmarshal(raw, &block); err != nil || block == nil {
+			return path + " must be an object."
+		}
+		if msg := checkLength(block, path, "block_id", MAX_BLOCK_ID, false); msg != "" {
+			return msg
+		}
+		if id, _ := block["block_id"].(string); id != "" {
+			if ids[id] {
+				return path + ".block_id " + id + " is used more than once."
+			}
+			ids[id] = true
+		}
+		if msg := validateBlock(block, path); msg != "" {
+			return msg
+		}
+	} // for
+	return ""
+} // func
+
+// validateBlock checks a single block according to its type.
+func validateBlock(block blockObject, path string) string {
+	kind, _ := block["type"].(string)
+	switch kind {
+	case "divider":
+		return ""
+	case "header":
+		return checkText(block["text"], path+".text", MAX_HEADER_TEXT, true, true)
+	case "section":
+		_, hasText := block["text"]
+		_, hasFields := block["fields"]
+		if !hasText && !hasFields {
+			return path + " needs text or fields."
+		}
+		if hasText {
+			if msg := checkText(block["text"], path+".text", MAX_SECTION_TEXT, false, true); msg != "" {
+				return msg
+			}
+		}
+		if hasFields {
+			fields, ok := block["fields"].([]interface{})
+			if !ok || len(fields) == 0 {
+				return path + ".fields must be a list of text objects."
+			}
+			if len(fields) > MAX_SECTION_FIELDS {
+				return fmt.Sprintf("%s.fields can have no more than %d items.", path, MAX_SECTION_FIELDS)
+			}
+			for j, field := range fields {
+				if msg := checkText(field, fmt.Sprintf("%s.fields[%d]", path, j), MAX_FIELD_TEXT, false, true); msg != "" {
+					return msg
+				}
+			} // for
+		}
+		if accessory, ok := block["accessory"]; ok {
+			return validateElement(accessory, path+".accessory")
+		}
+		return ""
+	case "image":
+		if msg := checkLength(block, path, "image_url", MAX_IMAGE_URL, true); msg != "" {
+			return msg
+		}
+		if msg := checkLength(block, path, "alt_text", MAX_ALT_TEXT, true); msg != "" {
+			return msg
+		}
+		if title, ok := block["title"]; ok {
+			return checkText(title, path+".title", MAX_FIELD_TEXT, true, true)
+		}
+		return ""
+	case "context":
+		elements, msg := checkList(block, path, "elements", MAX_CONTEXT_ELEMENTS)
+		if msg != "" {
+			return msg
+		}
+		for j, element := range elements {
+			epath := fmt.Sprintf("%s.elements[%d]", path, j)
+			if obj, ok := element.(map[string]interface{}); ok && obj["type"] == "image" {
+				if msg := checkLength(obj, epath, "image_url", MAX_IMAGE_URL, true); msg != "" {
+					return msg
+				}
+				if msg := checkLength(obj, epath, "alt_text", MAX_ALT_TEXT, true); msg != "" {
+					return msg
+				}
+				continue
+			}
+			if msg := checkText(element, epath, MAX_SECTION_TEXT, false, true); msg != "" {
+				return msg
+			}
+		} // for
+		return ""
+	case "actions":
+		elements, msg := checkList(block, path, "elements", MAX_ACTIONS_ELEMENTS)
+		if msg != "" {
+			return msg
+		}
+		for j, element := range elements {
+			if msg := validateElement(element, fmt.Sprintf("%s.elements[%d]", path, j)); msg != "" {
+				return msg
+			}
+		} // for
+		return ""
+	case "rich_text":
+		_, msg := checkList(block, path, "elements", 0)
+		return msg
+	case "video":
+		for _, field := range []string{"video_url", "thumbnail_url"} {
+			if msg := checkLength(block, path, field, MAX_IMAGE_URL, true); msg != "" {
+				return msg
+			}
+		} // for
+		if msg := checkLength(block, path, "alt_text", MAX_ALT_TEXT, true); msg != "" {
+			return msg
+		}
+		if msg := checkText(block["title"], path+".title", MAX_VIDEO_TITLE, true, true); msg != "" {
+			return msg
+		}
+		if description, ok := block["description"]; ok {
+			return checkText(description, path+".description", MAX_VIDEO_DESCRIPTION, true, true)
+		}
+		return ""
+	case "":
+		return path + ".type is missing."
+	}
+	return path + ".type " + kind + " is not a block that can be sent in a message."
+} // func
+
+// validateElement checks an interactive element of an actions block or a section
+// accessory.
+func validateElement(value interface{}, path string) string {
+	element, ok := value.(map[string]interface{})
+	if !ok {
+		return path + " must be an object."
+	}
+	if msg := checkLength(element, path, "action_id", MAX_ACTION_ID, false); msg != "" {
+		return msg
+	}
+	kind, _ := element["type"].(string)
+	switch kind {
+	case "button":
+		if msg := checkText(element["text"], path+".text", MAX_BUTTON_TEXT, true, true); msg != "" {
+			return msg
+		}
+		if msg := checkLength(element, path, "url", MAX_IMAGE_URL, false); msg != "" {
+			return msg
+		}
+		if msg := checkLength(element, path, "value", MAX_BUTTON_VALUE, false); msg != "" {
+			return msg
+		}
+		if style, ok := element["style"]; ok && style != "primary" && style != "danger" {
+			return path + ".style must be primary or danger."
+		}
+		return ""
+	case "image":
+		if msg := checkLength(element, path, "image_url", MAX_IMAGE_URL, true); msg != "" {
+			return msg
+		}
+		return checkLength(element, path, "alt_text", MAX_ALT_TEXT, true)
+	case "overflow":
+		return checkOptions(element, path, MAX_OVERFLOW_OPTIONS, true)
+	case "static_select", "multi_static_select":
+		if placeholder, ok := element["placeholder"]; ok {
+			if msg := checkText(placeholder, path+".placeholder", MAX_PLACEHOLDER_TEXT, true, true); msg != "" {
+				return msg
+			}
+		}
+		if _, ok := element["option_groups"]; ok {
+			return ""
+		}
+		return checkOptions(element, path, MAX_SELECT_OPTIONS, true)
+	case "checkboxes", "radio_buttons":
+		return checkOptions(element, path, MAX_CHECKBOX_OPTIONS, false)
+	case "users_select", "multi_users_select", "channels_select", "multi_channels_select",
+		"conversations_select", "multi_conversations_select", "external_select",
+		"multi_external_select", "datepicker", "timepicker", "datetimepicker":
+		if placeholder, ok := element["placeholder"]; ok {
+			return checkText(placeholder, path+".placeholder", MAX_PLACEHOLDER_TEXT, true, true)
+		}
+		return ""
+	case "":
+		return path + ".type is missing."
+	}
+	return path + ".type " + kind + " is not an element that can be used here."
+} // func
+
+// checkLength checks that the field is a string no longer than max.
+func checkLength(obj map[string]interface{}, path string, field string, max int, required bool) string {
+	value, ok := obj[field]
+	if !ok {
+		if required {
+			return path + "." + field + " is missing."
+		}
+		return ""
+	}
+	s, ok := value.(string)
+	if !ok {
+		return path + "." + field + " must be a string."
+	}
+	if required && strings.TrimSpace(s) == "" {
+		return path + "." + field + " can't be empty."
+	}
+	if len([]rune(s)) > max {
+		return fmt.Sprintf("%s.%s is longer than %d characters.", path, field, max)
+	}
+	return ""
+} // func
+
+// checkList checks that the field is a list with at least one item and no more than
+// max, unless max is zero.
+func checkList(obj map[string]interface{}, path string, field string, max int) ([]interface{}, string) {
+	list, ok := obj[field].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, path + "." + field + " must be a list with at least one item."
+	}
+	if max > 0 && len(list) > max {
+		return nil, fmt.Sprintf("%s.%s can have no more than %d items.", path, field, max)
+	}
+	return list, ""
+} // func
+
+// checkOptions checks the options of a select menu, overflow menu or set of checkboxes.
+func checkOptions(element map[string]interface{}, path string, max int, plainOnly bool) string {
+	options, msg := checkList(element, path, "options", max)
+	if msg != "" {
+		return msg
+	}
+	for j, option := range options {
+		opath := fmt.Sprintf("%s.options[%d]", path, j)
+		obj, ok := option.(map[string]interface{})
+		if !ok {
+			return opath + " must be an object."
+		}
+		if msg := checkText(obj["text"], opath+".text", MAX_OPTION_TEXT, plainOnly, true); msg != "" {
+			return msg
+		}
+		if msg := checkLength(obj, opath, "value", MAX_OPTION_VALUE, true); msg != "" {
+			return msg
+		}
+	} // for
+	return ""
+} // func
+
+// checkText checks a text object: its type, and the length of its text.
+func checkText(value interface{}, path string, max int, plainOnly bool, required bool) string {
+	if value == nil {
+		if required {
+			return path + " is missing."
+		}
+		return ""
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return path + " must be a text object."
+	}
+	switch obj["type"] {
+	case "plain_text":
+	case "mrkdwn":
+		if plainOnly {
+			return path + ".type must be plain_text."
+		}
+	default:
+		if plainOnly {
+			return path + ".type must be plain_text."
+		}
+		return path + ".type must be plain_text or mrkdwn."
+	}
+	return checkLength(obj, path, "text", max, true)
+} // func
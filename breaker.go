@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-martini/martini"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+)
+
+// Breaker defaults used when config.json does not override them.
+const (
+	DEFAULT_BREAKER_THRESHOLD = 5
+	DEFAULT_BREAKER_COOLDOWN  = 60
+	MAX_BREAKER_EVENTS        = 100
+)
+
+var (
+	breakers      map[string]*CircuitBreaker
+	breakerEvents []BreakerEvent
+	breakerLock   sync.Mutex
+)
+
+// CircuitBreaker keeps track of how a single hook has been doing.  Once a hook has
+// failed enough times in a row, messages for it are held back until the hook has had
+// time to recover, instead of each one sitting through its retries.
+type CircuitBreaker struct {
+	Id          string    `json:"id"`
+	Hook        string    `json:"hook"`
+	State       string    `json:"state"`
+	Failures    int       `json:"failures"`
+	LastFailure string    `json:"last_failure,omitempty"`
+	Opened      time.Time `json:"opened,omitempty"`
+	Deactivated bool      `json:"deactivated"`
+}
+
+// BreakerEvent is a single change in a breaker's state.
+type BreakerEvent struct {
+	Time    time.Time `json:"time"`
+	Breaker string    `json:"breaker"`
+	Hook    string    `json:"hook"`
+	Event   string    `json:"event"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Slack's answers for a hook (or channel) that is never coming back.
+var permanentFailures = []string{
+	"no_service",
+	"no_team",
+	"team_disabled",
+	"invalid_token",
+	"action_prohibited",
+	"channel_is_archived",
+	"channel_not_found",
+}
+
+// AllowDelivery tells the caller if the hook's breaker will let a message through.
+// Once the cooldown is up, an open breaker lets a single message through to see if
+// the hook has recovered.  If the message can't go yet, it also returns how long to
+// wait before asking again.  The wait is zero if the hook is gone for good.
+func AllowDelivery(hook string) (bool, time.Duration) {
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+	cb, ok := breakers[hook]
+	if !ok || cb.State == BREAKER_CLOSED {
+		return true, 0
+	}
+	if cb.Deactivated {
+		return false, 0
+	}
+	if cb.State == BREAKER_HALF_OPEN {
+		return false, BreakerCooldown()
+	}
+	if wait := BreakerCooldown() - time.Since(cb.Opened); wait > 0 {
+		return false, wait
+	}
+	cb.State = BREAKER_HALF_OPEN
+	addBreakerEvent(cb, "probe", "")
+	return true, 0
+} // func
+
+// BreakerCooldown is how long a breaker stays open before letting a probe through.
+func BreakerCooldown() time.Duration {
+	if appConfig.BreakerCooldownSeconds > 0 {
+		return time.Duration(appConfig.BreakerCooldownSeconds) * time.Second
+	}
+	return DEFAULT_BREAKER_COOLDOWN * time.Second
+} // func
+
+// GetBreakers lists every breaker along with the most recent trips and recoveries.
+func GetBreakers(rsp http.ResponseWriter) (int, string) {
+	breakerLock.Lock()
+	list := []CircuitBreaker{}
+	for _, cb := range breakers {
+		list = append(list, *cb)
+	} // for
+	events := append([]BreakerEvent{}, breakerEvents...)
+	breakerLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return JsonResponse(rsp, http.StatusOK, struct {
+		Breakers []CircuitBreaker `json:"breakers"`
+		Events   []BreakerEvent   `json:"events"`
+	}{list, events})
+} // func
+
+// IsPermanentFailure tells the caller if Slack has said the hook is gone for good.
+// It also returns the reason Slack gave.  Slack's answer is checked before the status,
+// since a 404 can be about the channel rather than the hook.
+func IsPermanentFailure(attempt DeliveryAttempt) (bool, string) {
+	if attempt.StatusCode >= 400 && attempt.StatusCode < 500 {
+		for _, code := range permanentFailures {
+			if strings.Contains(attempt.Response, code) {
+				return true, code
+			}
+		} // for
+	}
+	if attempt.StatusCode == http.StatusNotFound || attempt.StatusCode == http.StatusGone {
+		return true, fmt.Sprintf("%d %s", attempt.StatusCode, attempt.Response)
+	}
+	return false, ""
+} // func
+
+// MaskHook hides the secret part of a hook URL so it can be shown to people.
+func MaskHook(hook string) string {
+	if i := strings.LastIndex(hook, "/"); i >= 0 && i < len(hook)-1 {
+		return hook[:i+1] + "****"
+	}
+	return "****"
+} // func
+
+// RecordDelivery updates the hook's breaker with the outcome of a message.  If Slack
+// says the hook is gone for good, every slacker using it is deactivated.
+func RecordDelivery(doc SlackMessageOut, delivered bool) {
+	if delivered {
+		closeBreaker(doc.Hook)
+		return
+	}
+
+	last := DeliveryAttempt{}
+	if len(doc.Attempts) > 0 {
+		last = doc.Attempts[len(doc.Attempts)-1]
+	}
+	permanent, reason := IsPermanentFailure(last)
+	if reason == "" {
+		reason = DeliveryFailure(doc)
+	}
+	// Channel problems only take out the slackers posting to that channel.  The
+	// hook itself may be fine for everyone else.
+	channelOnly := reason == "channel_is_archived" || reason == "channel_not_found"
+	hookGone := permanent && !channelOnly
+	if permanent {
+		channel, gone := "", "hook"
+		if channelOnly {
+			channel, gone = doc.Payload.Channel, "channel"
+		}
+		for _, scfg := range DeactivateSlackers(doc.Hook, channel) {
+			log.Printf("warn: Deactivated slacker %s/%s", SlackerLabel(scfg, scfg.Key), reason)
+			NotifyFailure(scfg.Key, true, doc.Id, "Slacker deactivated, Slack says the "+gone+" is gone/"+reason)
+		} // for
+	}
+
+	// Only trouble with the hook itself counts against it: Slack couldn't be reached,
+	// had a 5xx, kept throttling until the attempts ran out, or says the hook is gone.
+	// A message Slack turned down, like invalid_blocks, shows the hook is working.
+	if !last.Retryable() && !hookGone {
+		closeBreaker(doc.Hook)
+		return
+	}
+
+	breakerLock.Lock()
+	if breakers == nil {
+		breakers = make(map[string]*CircuitBreaker)
+	}
+	cb, ok := breakers[doc.Hook]
+	if !ok {
+		cb = &CircuitBreaker{Id: breakerId(doc.Hook), Hook: MaskHook(doc.Hook), State: BREAKER_CLOSED}
+		breakers[doc.Hook] = cb
+	}
+	cb.Failures++
+	cb.LastFailure = reason
+	threshold := appConfig.BreakerThreshold
+	if threshold <= 0 {
+		threshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if cb.State == BREAKER_HALF_OPEN || cb.Failures >= threshold || hookGone {
+		if cb.State != BREAKER_OPEN {
+			addBreakerEvent(cb, "tripped", reason)
+			log.Printf("warn: Breaker %s tripped/%s", cb.Id, reason)
+		}
+		cb.State = BREAKER_OPEN
+		cb.Opened = time.Now().UTC()
+	}
+	if hookGone && !cb.Deactivated {
+		cb.Deactivated = true
+		addBreakerEvent(cb, "deactivated", reason)
+	}
+	breakerLock.Unlock()
+} // func
+
+// closeBreaker records that the hook is working, closing its breaker if need be.
+func closeBreaker(hook string) {
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+	if cb, ok := breakers[hook]; ok && (cb.State != BREAKER_CLOSED || cb.Failures > 0) {
+		if cb.State != BREAKER_CLOSED {
+			addBreakerEvent(cb, "recovered", "")
+			log.Printf("info: Breaker %s recovered", cb.Id)
+		}
+		cb.State = BREAKER_CLOSED
+		cb.Failures = 0
+	}
+} // func
+
+// ResetBreaker closes a breaker by hand, for instance after a deactivated hook has
+// been replaced.
+func ResetBreaker(params martini.Params) (int, string) {
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+	for hook, cb := range breakers {
+		if cb.Id == params["breaker_id"] {
+			addBreakerEvent(cb, "reset", "")
+			delete(breakers, hook)
+			return http.StatusOK, "Breaker reset."
+		}
+	} // for
+	return http.StatusNotFound, "Breaker does not exist."
+} // func
+
+// addBreakerEvent records a change in a breaker, keeping only the latest events.  The
+// caller must be holding the lock.
+func addBreakerEvent(cb *CircuitBreaker, event string, reason string) {
+	breakerEvents = append(breakerEvents, BreakerEvent{
+		Time:    time.Now().UTC(),
+		Breaker: cb.Id,
+		Hook:    cb.Hook,
+		Event:   event,
+		Reason:  reason,
+	})
+	if len(breakerEvents) > MAX_BREAKER_EVENTS {
+		breakerEvents = breakerEvents[len(breakerEvents)-MAX_BREAKER_EVENTS:]
+	}
+} // func
+
+// breakerId gives a breaker a short name that doesn't give the hook away.
+func breakerId(hook string) string {
+	h := fnv.New64a()
+	h.Write([]byte(hook))
+	return fmt.Sprintf("%016x", h.Sum64())
+} // func
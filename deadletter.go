@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"github.com/pborman/uuid"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dead letters for keys that don't belong to any slacker are kept to this many, so
+// posting with made up keys can't grow the dead letters without end.
+const (
+	MAX_UNKNOWN_KEY_LETTERS = 100
+	REASON_UNKNOWN_KEY      = "Could not find key"
+)
+
+var (
+	deadLetterFile string
+	deadLetterLog  string
+	deadLetters    map[string]DeadLetter
+	deadLetterLock sync.Mutex
+)
+
+// A DeadLetter is a message we could not get to Slack.  Depending on where it died
+// it carries either the inbound request or the outbound post, never both.
+type DeadLetter struct {
+	Id       string           `json:"id"`
+	Key      string           `json:"key"`
+	Reason   string           `json:"reason"`
+	Created  time.Time        `json:"created"`
+	Inbound  *SlackMessageIn  `json:"inbound,omitempty"`
+	Outbound *SlackMessageOut `json:"outbound,omitempty"`
+}
+
+// MessageId returns the Id of the message that died.
+func (dl DeadLetter) MessageId() string {
+	if dl.Inbound != nil {
+		return dl.Inbound.Id
+	}
+	if dl.Outbound != nil {
+		return dl.Outbound.Id
+	}
+	return ""
+} // func
+
+// NotifyOwner tells the caller if the slacker asked to hear about this failure.
+func (dl DeadLetter) NotifyOwner() bool {
+	if dl.Inbound != nil {
+		return dl.Inbound.NotifyOnError
+	}
+	if dl.Outbound != nil {
+		return dl.Outbound.NotifyOnError
+	}
+	return false
+} // func
+
+// AddDeadLetter records a message that could not be delivered.  The dead letter is
+// appended to the dead letter log right away since these are exactly the messages we
+// can't afford to lose.  The log is folded into the dead letter file at the next flush.
+func AddDeadLetter(reason string, key string, in *SlackMessageIn, out *SlackMessageOut) string {
+	dl := DeadLetter{
+		Id:       uuid.New(),
+		Key:      key,
+		Reason:   reason,
+		Created:  time.Now().UTC(),
+		Inbound:  in,
+		Outbound: out,
+	}
+
+	SetMessageState(dl.MessageId(), STATE_DEAD_LETTERED, reason)
+
+	deadLetterLock.Lock()
+	if deadLetters == nil {
+		deadLetters = make(map[string]DeadLetter)
+	}
+	deadLetters[dl.Id] = dl
+	log.Printf("warn: Dead letter %s for %s/%s", dl.Id, key, reason)
+	if err := appendDeadLetter(dl); err != nil {
+		log.Printf("error: Could not write to dead letter log/%s", err.Error())
+	}
+	deadLetterLock.Unlock()
+
+	// The dead letter file has it now, so it can come out of the queue log.
+	LogDone(dl.MessageId())
+	NotifyFailure(key, dl.NotifyOwner(), dl.MessageId(), reason)
+	return dl.Id
+} // func
+
+// AddUnknownKeyLetter dead letters a message whose key doesn't belong to any slacker.
+// Only the latest MAX_UNKNOWN_KEY_LETTERS of these are kept.
+func AddUnknownKeyLetter(doc SlackMessageIn) {
+	AddDeadLetter(REASON_UNKNOWN_KEY, doc.Key, &doc, nil)
+
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	unknown := []DeadLetter{}
+	for _, dl := range deadLetters {
+		if dl.Reason == REASON_UNKNOWN_KEY {
+			unknown = append(unknown, dl)
+		}
+	} // for
+	if len(unknown) <= MAX_UNKNOWN_KEY_LETTERS {
+		return
+	}
+	sort.Slice(unknown, func(i, j int) bool {
+		return unknown[i].Created.Before(unknown[j].Created)
+	})
+	for _, dl := range unknown[:len(unknown)-MAX_UNKNOWN_KEY_LETTERS] {
+		delete(deadLetters, dl.Id)
+	} // for
+} // func
+
+// appendDeadLetter writes the dead letter to the end of the dead letter log and makes
+// sure it is on disk before returning.  The caller must be holding the lock.
+func appendDeadLetter(dl DeadLetter) error {
+	buf, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	file, err := os.OpenFile(deadLetterLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(buf); err != nil {
+		return err
+	}
+	return file.Sync()
+} // func
+
+// FlushDeadLetters will write all of the dead letters to disk.
+func FlushDeadLetters() {
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	writeDeadLetters()
+} // func
+
+// writeDeadLetters does the actual work of saving the dead letters.  Once the file is
+// safely written, the dead letter log is started over.  The caller must be holding the
+// lock.
+func writeDeadLetters() {
+	file, err := os.Create(deadLetterFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	// Let's make the JSON pretty.
+	buf, err := json.MarshalIndent(deadLetters, "", "  ")
+	if err != nil {
+		log.Printf("error: Unable to encode Dead Letters JSON file/%s", err.Error())
+		return
+	}
+
+	// Now output the lot.
+	out := bytes.NewBuffer(buf)
+	_, err = out.WriteTo(file)
+	if err != nil {
+		log.Printf("error: Could not write to buffer/%s", err.Error())
+		return
+	}
+	if err = file.Sync(); err != nil {
+		log.Printf("error: Could not sync Dead Letters JSON file/%s", err.Error())
+		return
+	}
+	if err = os.Truncate(deadLetterLog, 0); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: Could not truncate dead letter log/%s", err.Error())
+	}
+} // func
+
+// GetDeadLetter returns a single dead letter, attempt history and all.
+func GetDeadLetter(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	deadLetterLock.Lock()
+	dl, ok := deadLetters[params["letter_id"]]
+	deadLetterLock.Unlock()
+	if !ok {
+		return http.StatusNotFound, "Dead letter does not exist."
+	}
+	return JsonResponse(rsp, http.StatusOK, dl)
+} // func
+
+// ListDeadLetters returns the dead letters, oldest first.  A "key" query parameter
+// limits the list to a single slacker.
+func ListDeadLetters(req *http.Request, rsp http.ResponseWriter) (int, string) {
+	return JsonResponse(rsp, http.StatusOK, SelectDeadLetters(req.URL.Query().Get("key")))
+} // func
+
+// LoadDeadLetters reads the dead letter file into memory, along with anything in the
+// dead letter log that hasn't been folded into the file yet.
+func LoadDeadLetters() bool {
+	loaded := make(map[string]DeadLetter)
+	file, err := os.Open(deadLetterFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	if err == nil {
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		if err = decoder.Decode(&loaded); err != nil {
+			log.Printf("error: Could not decode Dead Letters JSON/%s", err.Error())
+			return false
+		}
+	}
+
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	if !readDeadLetterLog(loaded) {
+		return false
+	}
+	deadLetters = loaded
+	log.Printf("info: Loaded %d Dead Letters from disk.", len(deadLetters))
+	return true
+} // func
+
+// readDeadLetterLog adds the dead letters in the log to the ones given.  A line cut
+// short by a crash is skipped.  The caller must be holding the lock.
+func readDeadLetterLog(loaded map[string]DeadLetter) bool {
+	file, err := os.Open(deadLetterLog)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			log.Printf("error: Could not decode dead letter log entry/%s", err.Error())
+			continue
+		}
+		loaded[dl.Id] = dl
+	} // for
+	if err := scanner.Err(); err != nil {
+		log.Printf("error: Could not read dead letter log/%s", err.Error())
+		return false
+	}
+	return true
+} // func
+
+// PurgeDeadLetter throws away a single dead letter.
+func PurgeDeadLetter(params martini.Params) (int, string) {
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	if _, ok := deadLetters[params["letter_id"]]; !ok {
+		return http.StatusNotFound, "Dead letter does not exist."
+	}
+	delete(deadLetters, params["letter_id"])
+	writeDeadLetters()
+	return http.StatusOK, "Dead letter purged."
+} // func
+
+// PurgeDeadLetters throws away every dead letter, or just those for the slacker in
+// the "key" query parameter.
+func PurgeDeadLetters(req *http.Request) (int, string) {
+	key := req.URL.Query().Get("key")
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	z := 0
+	for id, dl := range deadLetters {
+		if key == "" || dl.Key == key {
+			delete(deadLetters, id)
+			z++
+		}
+	} // for
+	writeDeadLetters()
+	return http.StatusOK, strconv.Itoa(z) + " dead letters purged."
+} // func
+
+// ReplayDeadLetter puts a single dead letter back on the queue it died in.
+func ReplayDeadLetter(params martini.Params) (int, string) {
+	deadLetterLock.Lock()
+	dl, ok := deadLetters[params["letter_id"]]
+	deadLetterLock.Unlock()
+	if !ok {
+		return http.StatusNotFound, "Dead letter does not exist."
+	}
+	if !replayDeadLetter(dl) {
+		return http.StatusServiceUnavailable, "Queue is full, try again later."
+	}
+	return http.StatusOK, "Dead letter replayed."
+} // func
+
+// ReplayDeadLetters puts every dead letter, or just those for the slacker in the
+// "key" query parameter, back on the queues.  It stops as soon as a queue fills up.
+func ReplayDeadLetters(req *http.Request) (int, string) {
+	z := 0
+	for _, dl := range SelectDeadLetters(req.URL.Query().Get("key")) {
+		if !replayDeadLetter(dl) {
+			return http.StatusServiceUnavailable, strconv.Itoa(z) + " dead letters replayed before the queue filled up."
+		}
+		z++
+	} // for
+	return http.StatusOK, strconv.Itoa(z) + " dead letters replayed."
+} // func
+
+// replayDeadLetter requeues the message and removes the dead letter if that worked.
+// An inbound message's time to live starts over and a post's is dropped, or an expired
+// message would only expire again.
+func replayDeadLetter(dl DeadLetter) bool {
+	queued := false
+	SetMessageState(dl.MessageId(), STATE_QUEUED, "Replayed")
+	if dl.Inbound != nil {
+		doc := *dl.Inbound
+		doc.Accepted = time.Now().UTC()
+		queued = LogInbound(doc) == nil && FillInboundList(doc)
+	} else if dl.Outbound != nil {
+		doc := *dl.Outbound
+		doc.Expires = time.Time{}
+		queued = LogOutbound(doc) == nil && FillOutboundList(doc)
+	}
+	if !queued {
+		SetMessageState(dl.MessageId(), STATE_DEAD_LETTERED, dl.Reason)
+		LogDone(dl.MessageId())
+		return false
+	}
+
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	delete(deadLetters, dl.Id)
+	writeDeadLetters()
+	log.Printf("info: Replayed dead letter %s", dl.Id)
+	return true
+} // func
+
+// SelectDeadLetters returns the dead letters for a slacker, or all of them if no key
+// is given, oldest first.
+func SelectDeadLetters(key string) []DeadLetter {
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	list := []DeadLetter{}
+	for _, dl := range deadLetters {
+		if key == "" || dl.Key == key {
+			list = append(list, dl)
+		}
+	} // for
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+} // func
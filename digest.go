@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pborman/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Digest defaults and limits.
+const (
+	DEFAULT_COALESCE_WINDOW = 60
+	DIGEST_SAMPLE_LINES     = 3
+	DIGEST_LINE_LENGTH      = 200
+)
+
+// Coalescers are only ever touched from the background loop, so they need no lock.
+var (
+	coalescers map[string]*Coalescer
+)
+
+// Coalescer tracks how fast a slacker has been sending, and holds their messages once
+// they go over the limit.
+type Coalescer struct {
+	Arrivals []time.Time
+	Held     []SlackMessageIn
+	Until    time.Time
+}
+
+// CoalesceMessage decides whether the message should go into a digest.  Once a slacker
+// sends more than its threshold within the window, everything it sends for the next
+// window is held and then posted as a single digest.
+func CoalesceMessage(doc SlackMessageIn, scfg SlackConfig) bool {
+	if scfg.CoalesceThreshold <= 0 {
+		return false
+	}
+	window := time.Duration(DEFAULT_COALESCE_WINDOW) * time.Second
+	if scfg.CoalesceWindowSeconds > 0 {
+		window = time.Duration(scfg.CoalesceWindowSeconds) * time.Second
+	}
+
+	if coalescers == nil {
+		coalescers = make(map[string]*Coalescer)
+	}
+	c, ok := coalescers[scfg.Key]
+	if !ok {
+		c = &Coalescer{}
+		coalescers[scfg.Key] = c
+	}
+
+	now := time.Now()
+	if now.Before(c.Until) {
+		c.Held = append(c.Held, doc)
+		return true
+	}
+
+	// Only count what arrived within the window.
+	recent := c.Arrivals[:0]
+	for _, t := range c.Arrivals {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	} // for
+	c.Arrivals = append(recent, now)
+	if len(c.Arrivals) <= scfg.CoalesceThreshold {
+		return false
+	}
+
+	c.Until = now.Add(window)
+	c.Held = append(c.Held, doc)
+	return true
+} // func
+
+// BuildDigest merges the held messages into one under the given heading.  The digest
+// takes on the most important action and priority of the bunch so an error doesn't
+// get hidden behind an info icon.  The messages must all be going to the same channel.
+func BuildDigest(key string, held []SlackMessageIn, heading string) SlackMessageIn {
+	scfg := GetSlacker(key)
+	counts := make(map[string]int)
+	action := held[0].Action
+	priority := PRIORITY_LOW
+	notify := false
+	for _, doc := range held {
+		name := doc.Action
+		if name == "" {
+			name = "none"
+		}
+		counts[name]++
+		if ActionPriority(doc.Action, scfg) > ActionPriority(action, scfg) {
+			action = doc.Action
+		}
+		if p := MessagePriority(doc.Priority, doc.Action, key); p > priority {
+			priority = p
+		}
+		notify = notify || doc.NotifyOnError
+	} // for
+
+	names := []string{}
+	for name := range counts {
+		names = append(names, name)
+	} // for
+	sort.Strings(names)
+	tally := []string{}
+	for _, name := range names {
+		tally = append(tally, fmt.Sprintf("%s: %d", name, counts[name]))
+	} // for
+
+	lines := []string{fmt.Sprintf("%s (%s)", heading, strings.Join(tally, ", "))}
+	if len(held) <= 2*DIGEST_SAMPLE_LINES {
+		lines = append(lines, digestLines(held)...)
+	} else {
+		lines = append(lines, "First:")
+		lines = append(lines, digestLines(held[:DIGEST_SAMPLE_LINES])...)
+		lines = append(lines, "Last:")
+		lines = append(lines, digestLines(held[len(held)-DIGEST_SAMPLE_LINES:])...)
+	}
+
+	return SlackMessageIn{
+		Id:            uuid.New(),
+		Key:           key,
+		Channel:       held[0].Channel,
+		Action:        action,
+		Priority:      PRIORITY_NAMES[priority],
+		Text:          strings.Join(lines, "\n"),
+		NotifyOnError: notify,
+		Accepted:      time.Now().UTC(),
+	}
+} // func
+
+// ReleaseDigests posts a digest for every slacker whose window has closed.
+func ReleaseDigests() {
+	now := time.Now()
+	for key, c := range coalescers {
+		if now.Before(c.Until) {
+			continue
+		}
+		if len(c.Held) == 0 {
+			// Nothing held and nothing recent, so stop tracking the slacker.
+			if len(c.Arrivals) == 0 || now.Sub(c.Arrivals[len(c.Arrivals)-1]) > time.Hour {
+				delete(coalescers, key)
+			}
+			continue
+		}
+
+		held := c.Held
+		c.Held = nil
+		c.Arrivals = nil
+		scfg := GetSlacker(key)
+		window := time.Duration(DEFAULT_COALESCE_WINDOW) * time.Second
+		if scfg.CoalesceWindowSeconds > 0 {
+			window = time.Duration(scfg.CoalesceWindowSeconds) * time.Second
+		}
+		heading := fmt.Sprintf("*Digest of %%d messages from the last %d seconds*", int(window.Seconds()))
+		releaseHeld(key, scfg, held, heading, "Merged into digest ", false)
+	} // for
+} // func
+
+// releaseHeld sends what was held back for a slacker as a summary for each channel.
+// The heading is a format that is given the number of messages, and each message
+// summed up is marked coalesced with the reason and the summary's Id.  With postLone
+// set, a channel with only one message gets it as it was sent instead.
+func releaseHeld(key string, scfg SlackConfig, held []SlackMessageIn, heading string, reason string, postLone bool) {
+	if scfg.Key == "" || !scfg.IsActive() {
+		// The slacker went away while we were holding its messages.  Let each one
+		// go through the usual path so it gets dead lettered properly.
+		for _, doc := range held {
+			ProcessInbound(doc)
+		} // for
+		return
+	}
+
+	for _, group := range splitByChannel(held) {
+		if postLone && len(group) == 1 {
+			PostMessage(group[0], scfg)
+			continue
+		}
+		summary := BuildDigest(key, group, fmt.Sprintf(heading, len(group)))
+		TrackMessage(summary.Id)
+		SendOutbound(BuildOutbound(summary, scfg))
+
+		// The summary is in the queue log now, so the messages it covers are done.
+		for _, doc := range group {
+			SetMessageState(doc.Id, STATE_COALESCED, reason+summary.Id)
+			LogDone(doc.Id)
+		} // for
+	} // for
+} // func
+
+// digestLines picks out the first line of each message for the digest.  A message
+// with nothing but attachments is known by its first one.
+func digestLines(held []SlackMessageIn) []string {
+	lines := []string{}
+	for _, doc := range held {
+		text := doc.Text
+		if text == "" && len(doc.Attachments) > 0 {
+			text = doc.Attachments[0].Fallback
+			if text == "" {
+				text = doc.Attachments[0].Title
+			}
+			if text == "" {
+				text = doc.Attachments[0].Text
+			}
+		}
+		if text == "" {
+			text = BlocksText(doc.Blocks)
+		}
+		line := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+		if runes := []rune(line); len(runes) > DIGEST_LINE_LENGTH {
+			line = string(runes[:DIGEST_LINE_LENGTH]) + "..."
+		}
+		lines = append(lines, "> "+line)
+	} // for
+	return lines
+} // func
+
+// splitByChannel groups the held messages by the channel they are going to, keeping
+// them in the order they came in.  Messages for different channels can't share a post.
+func splitByChannel(held []SlackMessageIn) [][]SlackMessageIn {
+	groups := [][]SlackMessageIn{}
+	index := make(map[string]int)
+	for _, doc := range held {
+		i, ok := index[doc.Channel]
+		if !ok {
+			i = len(groups)
+			index[doc.Channel] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], doc)
+	} // for
+	return groups
+} // func
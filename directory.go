@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	directoryFile string
+	directory     map[string]DirectoryEntry
+	directoryLock sync.RWMutex
+
+	// A mention is an @ at the start of a word, then a handle or an email address.
+	mentionPattern = regexp.MustCompile(`(^|[\s(\[{,;:])@([A-Za-z0-9._+-]+(@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+)?)`)
+	directoryName  = regexp.MustCompile(`^[A-Za-z0-9._+-]+(@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+)?$`)
+	slackUserId    = regexp.MustCompile(`^[UWS][A-Z0-9]+$`)
+)
+
+// DirectoryEntry maps a name people write after an @ (an email address, a handle or an
+// alias like oncall) to a Slack user or user group.
+type DirectoryEntry struct {
+	Name    string `json:"name"`     // without the @, matched regardless of case
+	SlackId string `json:"slack_id"` // U or W for a person, S for a user group
+}
+
+// Mention is how Slack wants the entry written in a message.
+func (de DirectoryEntry) Mention() string {
+	if strings.HasPrefix(de.SlackId, "S") {
+		return "<!subteam^" + de.SlackId + ">"
+	}
+	return "<@" + de.SlackId + ">"
+} // func
+
+// DeleteDirectoryEntry removes a name from the directory.
+func DeleteDirectoryEntry(params martini.Params) (int, string) {
+	name := strings.ToLower(params["name"])
+	directoryLock.Lock()
+	defer directoryLock.Unlock()
+	if _, ok := directory[name]; !ok {
+		return http.StatusNotFound, "Directory entry does not exist."
+	}
+	delete(directory, name)
+	writeDirectory()
+	return http.StatusOK, "Directory entry deleted."
+} // func
+
+// FlushDirectory will write the directory to disk.
+func FlushDirectory() {
+	directoryLock.RLock()
+	defer directoryLock.RUnlock()
+	writeDirectory()
+} // func
+
+// writeDirectory does the actual work of saving the directory.  It is done whenever an
+// entry changes, so the file is never behind when it is reloaded.  The caller must be
+// holding the lock.
+func writeDirectory() {
+	file, err := os.Create(directoryFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	// Let's make the JSON pretty.
+	buf, err := json.MarshalIndent(directory, "", "  ")
+	if err != nil {
+		log.Printf("error: Could not encode Directory JSON/%s", err.Error())
+		return
+	}
+
+	// Now output the lot.
+	out := bytes.NewBuffer(buf)
+	_, err = out.WriteTo(file)
+	if err != nil {
+		log.Printf("error: Could not write to buffer/%s", err.Error())
+	}
+} // func
+
+// GetDirectoryEntry returns a single directory entry.
+func GetDirectoryEntry(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	directoryLock.RLock()
+	de, ok := directory[strings.ToLower(params["name"])]
+	directoryLock.RUnlock()
+	if !ok {
+		return http.StatusNotFound, "Directory entry does not exist."
+	}
+	return JsonResponse(rsp, http.StatusOK, de)
+} // func
+
+// ListDirectory returns the whole directory, by name.
+func ListDirectory(rsp http.ResponseWriter) (int, string) {
+	directoryLock.RLock()
+	list := []DirectoryEntry{}
+	for _, de := range directory {
+		list = append(list, de)
+	} // for
+	directoryLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return JsonResponse(rsp, http.StatusOK, list)
+} // func
+
+// LoadDirectory reads the directory from disk.  Names are matched regardless of case,
+// so they are keyed in lower case whatever the file says.
+func LoadDirectory() bool {
+	file, err := os.Open(directoryFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	decoded := make(map[string]DirectoryEntry)
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&decoded)
+	if err != nil {
+		log.Printf("error: Could not decode Directory JSON/%s", err.Error())
+		return false
+	}
+	loaded := make(map[string]DirectoryEntry)
+	for key, de := range decoded {
+		if de.Name == "" {
+			de.Name = key
+		}
+		loaded[strings.ToLower(de.Name)] = de
+	} // for
+	directoryLock.Lock()
+	defer directoryLock.Unlock()
+	directory = loaded
+	log.Printf("info: Loaded %d Directory entries from disk.", len(directory))
+	return true
+} // func
+
+// PutDirectoryEntry adds a name to the directory, or points it somewhere new.
+func PutDirectoryEntry(de DirectoryEntry, params martini.Params, rsp http.ResponseWriter) (int, string) {
+	de.Name = strings.TrimPrefix(params["name"], "@")
+	if !directoryName.MatchString(de.Name) {
+		return http.StatusBadRequest, "Name must be a handle or an email address."
+	}
+	if !slackUserId.MatchString(de.SlackId) {
+		return http.StatusBadRequest, "slack_id must be a Slack user (U or W) or user group (S) Id."
+	}
+	directoryLock.Lock()
+	defer directoryLock.Unlock()
+	if directory == nil {
+		directory = make(map[string]DirectoryEntry)
+	}
+	directory[strings.ToLower(de.Name)] = de
+	writeDirectory()
+	return JsonResponse(rsp, http.StatusOK, de)
+} // func
+
+// ResolveMentions turns every @name in the text that is in the directory into a real
+// Slack mention.  Names that aren't in the directory, and anything in code, are left
+// as they are.  Plain text is sent exactly as written, so it is left alone too.
+func ResolveMentions(doc SlackMessageIn) SlackMessageIn {
+	if doc.Format == FORMAT_PLAIN || !strings.Contains(doc.Text, "@") {
+		return doc
+	}
+	directoryLock.RLock()
+	defer directoryLock.RUnlock()
+	if len(directory) == 0 {
+		return doc
+	}
+
+	// Code is every other piece between backticks.
+	pieces := strings.Split(doc.Text, "`")
+	for i := 0; i < len(pieces); i += 2 {
+		pieces[i] = mentionPattern.ReplaceAllStringFunc(pieces[i], func(m string) string {
+			parts := mentionPattern.FindStringSubmatch(m)
+			// A sentence can end right after a name.
+			name := strings.TrimRight(parts[2], ".")
+			de, ok := directory[strings.ToLower(name)]
+			if !ok {
+				return m
+			}
+			return parts[1] + de.Mention() + parts[2][len(name):]
+		})
+	} // for
+	doc.Text = strings.Join(pieces, "`")
+	return doc
+} // func
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The formats a message's text can be sent in.
+const (
+	FORMAT_PLAIN    = "plain"    // no formatting at all
+	FORMAT_MARKDOWN = "markdown" // GitHub flavored, converted to mrkdwn
+	FORMAT_MRKDWN   = "mrkdwn"   // Slack's own, the default
+)
+
+var (
+	// Things Slack already understands, which shouldn't be escaped: entities, links,
+	// mentions and the like.
+	slackEntity  = regexp.MustCompile(`^&(amp|lt|gt);`)
+	slackControl = regexp.MustCompile(`^<([@#!][^<>\s]*|(https?|mailto):[^<>\s|]+(\|[^<>]*)?)>`)
+
+	mdHeading   = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.+?)\s*#*\s*$`)
+	mdBullet    = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	mdRule      = regexp.MustCompile(`^\s{0,3}([-*_]\s*){3,}$`)
+	mdImage     = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(\s+"[^"]*")?\)`)
+	mdLink      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(\s+"[^"]*")?\)`)
+	mdBold      = regexp.MustCompile(`\*\*(\S(.*?\S)?)\*\*|__(\S(.*?\S)?)__`)
+	mdItalic    = regexp.MustCompile(`\*(\S(.*?\S)?)\*`)
+	mdStrike    = regexp.MustCompile(`~~(\S(.*?\S)?)~~`)
+	mdCodeFence = regexp.MustCompile("^\\s*(```|~~~)")
+)
+
+// EscapeMrkdwn escapes the characters Slack treats as markup, &, < and >.  Anything
+// Slack would understand as-is (an entity, a link, a mention) is left alone, so text
+// can be escaped more than once without harm.
+func EscapeMrkdwn(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '&':
+			if m := slackEntity.FindString(text[i:]); m != "" {
+				out.WriteString(m)
+				i += len(m)
+				continue
+			}
+			out.WriteString("&amp;")
+		case '<':
+			if m := slackControl.FindString(text[i:]); m != "" {
+				out.WriteString(m)
+				i += len(m)
+				continue
+			}
+			out.WriteString("&lt;")
+		case '>':
+			out.WriteString("&gt;")
+		default:
+			out.WriteByte(text[i])
+		}
+		i++
+	} // for
+	return out.String()
+} // func
+
+// EscapePlain escapes the text so Slack shows it exactly as it is.  Only entities are
+// left alone; links and mentions are shown as typed.
+func EscapePlain(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '&':
+			if m := slackEntity.FindString(text[i:]); m != "" {
+				out.WriteString(m)
+				i += len(m)
+				continue
+			}
+			out.WriteString("&amp;")
+		case '<':
+			out.WriteString("&lt;")
+		case '>':
+			out.WriteString("&gt;")
+		default:
+			out.WriteByte(text[i])
+		}
+		i++
+	} // for
+	return out.String()
+} // func
+
+// FormatMessage gets the message's text ready for Slack according to its format.
+// Markdown comes out as mrkdwn, and is marked that way so it isn't converted twice.
+func FormatMessage(doc SlackMessageIn) SlackMessageIn {
+	switch doc.Format {
+	case FORMAT_PLAIN:
+		doc.Text = EscapePlain(doc.Text)
+	case FORMAT_MARKDOWN:
+		doc.Text = MarkdownToMrkdwn(doc.Text)
+		doc.Format = FORMAT_MRKDWN
+	default:
+		doc.Text = EscapeMrkdwn(doc.Text)
+	} // switch
+	return doc
+} // func
+
+// MarkdownToMrkdwn converts GitHub flavored Markdown to Slack's mrkdwn.  Code blocks
+// and inline code are escaped but otherwise left as they are.
+func MarkdownToMrkdwn(text string) string {
+	lines := strings.Split(text, "\n")
+	inCode := false
+	for i, line := range lines {
+		if mdCodeFence.MatchString(line) {
+			// Slack doesn't do syntax highlighting, so drop the language name.
+			inCode = !inCode
+			lines[i] = "```"
+			continue
+		}
+		if inCode {
+			lines[i] = EscapePlain(line)
+			continue
+		}
+		lines[i] = convertMarkdownLine(line)
+	} // for
+	return strings.Join(lines, "\n")
+} // func
+
+// ValidFormat tells the caller if the format is one we know.  Empty is the default.
+func ValidFormat(format string) bool {
+	switch format {
+	case "", FORMAT_PLAIN, FORMAT_MARKDOWN, FORMAT_MRKDWN:
+		return true
+	}
+	return false
+} // func
+
+// convertMarkdownLine converts one line of Markdown outside of a code block.
+func convertMarkdownLine(line string) string {
+	if mdRule.MatchString(line) {
+		return "──────────"
+	}
+	heading := false
+	if m := mdHeading.FindStringSubmatch(line); m != nil {
+		line = m[1]
+		heading = true
+	}
+	line = mdBullet.ReplaceAllString(line, "${1}• ")
+
+	// Inline code is every other piece between backticks, and is left alone.
+	pieces := strings.Split(line, "`")
+	for j := range pieces {
+		if j%2 == 1 && j < len(pieces)-1 {
+			pieces[j] = EscapePlain(pieces[j])
+			continue
+		}
+		pieces[j] = convertMarkdownSpan(pieces[j])
+	} // for
+	line = strings.Join(pieces, "`")
+
+	// Slack can't nest bold, and the whole heading is bold anyway.
+	if heading {
+		line = "*" + strings.Replace(line, "*", "", -1) + "*"
+	}
+	return line
+} // func
+
+// convertMarkdownSpan converts the inline markup in a piece of text.  Anything Slack
+// would understand as-is (a mention, a link in angle brackets) is set aside first, so
+// it is neither escaped nor restyled.
+func convertMarkdownSpan(text string) string {
+	const controlMark = "\x01"
+	var controls []string
+	var kept strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '<' {
+			if m := slackControl.FindString(text[i:]); m != "" {
+				controls = append(controls, m)
+				kept.WriteString(controlMark)
+				i += len(m) - 1
+				continue
+			}
+		}
+		kept.WriteByte(text[i])
+	} // for
+	text = EscapePlain(kept.String())
+	text = mdImage.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdImage.FindStringSubmatch(m)
+		if parts[1] == "" {
+			return "<" + parts[2] + ">"
+		}
+		return "<" + parts[2] + "|" + parts[1] + ">"
+	})
+	text = mdLink.ReplaceAllString(text, "<$2|$1>")
+
+	// Bold has to be set aside before italics, since both use asterisks.
+	const boldMark = "\x00"
+	text = mdBold.ReplaceAllStringFunc(text, func(m string) string {
+		return boldMark + m[2:len(m)-2] + boldMark
+	})
+	text = mdItalic.ReplaceAllString(text, "_${1}_")
+	text = strings.Replace(text, boldMark, "*", -1)
+	text = mdStrike.ReplaceAllString(text, "~${1}~")
+	for _, c := range controls {
+		text = strings.Replace(text, controlMark, c, 1)
+	} // for
+	return text
+} // func
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"github.com/pborman/uuid"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	groupFile string
+	groups    map[string]SlackerGroup
+	groupLock sync.RWMutex
+)
+
+// SlackerGroup sends one message to several slackers, which can post to different
+// channels or even different Slack workspaces.  A message sent with the group's key
+// goes out as a separate message, or leg, for each slacker.
+type SlackerGroup struct {
+	Key     string   `json:"key"`     // made up when the group is added
+	Name    string   `json:"name"`    // descriptive name
+	Members []string `json:"members"` // slacker keys
+}
+
+// GroupView is what a group looks like to someone holding only its key.  The slackers
+// are shown by name, since their keys would let the holder post as any of them.
+type GroupView struct {
+	Key     string   `json:"key"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"` // slacker names, or the start of their keys
+}
+
+// AddGroup saves a new group.  Only someone who already holds the slackers' keys can
+// put them in a group, so the keys are all the proof needed.
+func AddGroup(sg SlackerGroup, rsp http.ResponseWriter) (int, string) {
+	if msg := validateGroup(sg); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	sg.Key = uuid.New()
+
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	if groups == nil {
+		groups = make(map[string]SlackerGroup)
+	}
+	groups[sg.Key] = sg
+	writeGroups()
+	return JsonResponse(rsp, http.StatusCreated, sg)
+} // func
+
+// DeleteGroup removes a group.  The slackers in it are left alone.
+func DeleteGroup(params martini.Params) (int, string) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	if _, ok := groups[params["group_id"]]; !ok {
+		return http.StatusNotFound, "Group does not exist."
+	}
+	delete(groups, params["group_id"])
+	writeGroups()
+	return http.StatusOK, "Group deleted."
+} // func
+
+// FanOut accepts a message sent to a group by queuing a leg for each of its slackers.
+// Each leg has an Id of its own and is delivered and tracked on its own, so one bad
+// hook doesn't hold up the others.  The message's own Id lists the legs.
+func FanOut(smi SlackMessageIn, sg SlackerGroup, rsp http.ResponseWriter) (int, string) {
+	TrackMessage(smi.Id)
+	legs := []string{}
+	accepted := 0
+	full := false
+	for _, key := range sg.Members {
+		leg := smi
+		leg.Id = uuid.New()
+		leg.Key = key
+		leg.IdempotencyKey = ""
+		legs = append(legs, leg.Id)
+
+		TrackMessage(leg.Id)
+		if err := LogInbound(leg); err != nil {
+			log.Printf("error: Could not write to queue log/%s", err.Error())
+			SetMessageState(leg.Id, STATE_FAILED, "Could not persist message")
+			continue
+		}
+		if !FillInboundList(leg) {
+			full = true
+			SetMessageState(leg.Id, STATE_FAILED, "Inbound list is full")
+			LogDone(leg.Id)
+			NotifyFailure(leg.Key, leg.NotifyOnError, leg.Id, "Inbound list is full")
+			continue
+		}
+		accepted++
+	} // for
+	SetMessageLegs(smi.Id, legs)
+
+	// As long as one leg made it, the message was accepted.  The rest show up as failed.
+	if accepted > 0 {
+		SetMessageState(smi.Id, STATE_FANNED_OUT, strconv.Itoa(accepted)+" of "+strconv.Itoa(len(legs))+" legs accepted")
+		return JsonResponse(rsp, http.StatusAccepted, Receipt{Id: smi.Id, Status: "Accepted", Legs: legs})
+	}
+	ReleaseIdempotencyKey(smi.Key, smi.IdempotencyKey, smi.Id)
+	if !full {
+		SetMessageState(smi.Id, STATE_FAILED, "Could not persist message")
+		return http.StatusInternalServerError, "Could not persist message."
+	}
+	SetMessageState(smi.Id, STATE_FAILED, "Inbound list is full")
+	rsp.Header().Set("Retry-After", strconv.Itoa(inboundDrain.RetryAfter(InboundList.Len())))
+	return http.StatusServiceUnavailable, "Inbound list is full, try again later."
+} // func
+
+// FindGroup retrieves the group with the given key.  The key is empty if there is none.
+func FindGroup(key string) SlackerGroup {
+	groupLock.RLock()
+	defer groupLock.RUnlock()
+	return groups[key]
+} // func
+
+// FlushGroups will write all of the groups to disk.
+func FlushGroups() {
+	groupLock.RLock()
+	defer groupLock.RUnlock()
+	writeGroups()
+} // func
+
+// writeGroups does the actual work of saving the groups.  It is done whenever a group
+// changes, so the file is never behind when it is reloaded.  The caller must be holding
+// the lock.
+func writeGroups() {
+	file, err := os.Create(groupFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	// Let's make the JSON pretty.
+	buf, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		log.Printf("error: Could not encode Groups JSON/%s", err.Error())
+		return
+	}
+
+	// Now output the lot.
+	out := bytes.NewBuffer(buf)
+	_, err = out.WriteTo(file)
+	if err != nil {
+		log.Printf("error: Could not write to buffer/%s", err.Error())
+	}
+} // func
+
+// GetGroup returns a single group, without its slackers' keys.
+func GetGroup(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	sg := FindGroup(params["group_id"])
+	if sg.Key == "" {
+		return http.StatusNotFound, "Group does not exist."
+	}
+	view := GroupView{Key: sg.Key, Name: sg.Name, Members: []string{}}
+	for _, key := range sg.Members {
+		view.Members = append(view.Members, SlackerLabel(GetSlacker(key), key))
+	} // for
+	return JsonResponse(rsp, http.StatusOK, view)
+} // func
+
+// GroupMembers looks up the group's slackers.  A slacker that has been deleted comes
+// back empty, and its leg ends up as a dead letter.
+func GroupMembers(sg SlackerGroup) []SlackConfig {
+	list := []SlackConfig{}
+	for _, key := range sg.Members {
+		list = append(list, GetSlacker(key))
+	} // for
+	return list
+} // func
+
+// LoadGroups reads the groups from disk.
+func LoadGroups() bool {
+	file, err := os.Open(groupFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	loaded := make(map[string]SlackerGroup)
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&loaded)
+	if err != nil {
+		log.Printf("error: Could not decode Groups JSON/%s", err.Error())
+		return false
+	}
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	groups = loaded
+	log.Printf("info: Loaded %d Groups from disk.", len(groups))
+	return true
+} // func
+
+// UpdateGroup replaces the name and slackers of a group.  Anyone holding the group's
+// key could otherwise swap in a slacker of their own and read what is sent to it, so
+// this takes the admin key.
+func UpdateGroup(sg SlackerGroup, params martini.Params, rsp http.ResponseWriter) (int, string) {
+	if msg := validateGroup(sg); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	if _, ok := groups[params["group_id"]]; !ok {
+		return http.StatusNotFound, "Group does not exist."
+	}
+	sg.Key = params["group_id"]
+	groups[sg.Key] = sg
+	writeGroups()
+	return JsonResponse(rsp, http.StatusOK, sg)
+} // func
+
+// validateGroup returns what is wrong with the group, if anything.  Groups are made of
+// slackers, not other groups.
+func validateGroup(sg SlackerGroup) string {
+	if len(sg.Members) == 0 {
+		return "A group needs at least one slacker."
+	}
+	seen := make(map[string]bool)
+	for _, key := range sg.Members {
+		if seen[key] {
+			return "Slacker " + key + " is in the group twice."
+		}
+		seen[key] = true
+		if !ValidateSlacker(key) {
+			return "Slacker " + key + " does not exist."
+		}
+	} // for
+	return ""
+} // func
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long a key is remembered when config.json does not say.
+const DEFAULT_IDEMPOTENCY_WINDOW = 3600
+
+var (
+	idempotencyFile string
+	idempotencyKeys map[string]IdempotencyRecord
+	idempotencyLock sync.Mutex
+)
+
+// IdempotencyRecord remembers which message an idempotency key was first used for.
+type IdempotencyRecord struct {
+	MessageId string    `json:"message_id"`
+	Expires   time.Time `json:"expires"`
+}
+
+// ClaimIdempotencyKey ties the key to the message, unless the slacker already used
+// the key within the window.  In that case it returns false along with the Id of the
+// message that got there first.
+func ClaimIdempotencyKey(key string, idemKey string, msgId string) (string, bool) {
+	window := time.Duration(DEFAULT_IDEMPOTENCY_WINDOW) * time.Second
+	if appConfig.IdempotencyWindowSeconds > 0 {
+		window = time.Duration(appConfig.IdempotencyWindowSeconds) * time.Second
+	}
+
+	idempotencyLock.Lock()
+	defer idempotencyLock.Unlock()
+	if idempotencyKeys == nil {
+		idempotencyKeys = make(map[string]IdempotencyRecord)
+	}
+	now := time.Now().UTC()
+	id := key + "|" + idemKey
+	if rec, ok := idempotencyKeys[id]; ok && now.Before(rec.Expires) {
+		return rec.MessageId, false
+	}
+	idempotencyKeys[id] = IdempotencyRecord{MessageId: msgId, Expires: now.Add(window)}
+	return msgId, true
+} // func
+
+// FlushIdempotencyKeys will write the keys that are still in their window to disk.
+func FlushIdempotencyKeys() {
+	file, err := os.Create(idempotencyFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	// Let's make the JSON pretty.
+	idempotencyLock.Lock()
+	expireIdempotencyKeys()
+	buf, err := json.MarshalIndent(idempotencyKeys, "", "  ")
+	idempotencyLock.Unlock()
+	if err != nil {
+		log.Printf("error: Unable to encode Idempotency JSON file/%s", err.Error())
+		return
+	}
+
+	// Now output the lot.
+	out := bytes.NewBuffer(buf)
+	_, err = out.WriteTo(file)
+	if err != nil {
+		log.Printf("error: Could not write to buffer/%s", err.Error())
+	}
+} // func
+
+// LoadIdempotencyKeys reads the keys from disk.  What's on disk is merged with what's
+// in memory rather than replacing it, so a key claimed between a flush and a load is
+// never forgotten.
+func LoadIdempotencyKeys() bool {
+	file, err := os.Open(idempotencyFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	loaded := make(map[string]IdempotencyRecord)
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&loaded)
+	if err != nil {
+		log.Printf("error: Could not decode Idempotency JSON/%s", err.Error())
+		return false
+	}
+
+	idempotencyLock.Lock()
+	defer idempotencyLock.Unlock()
+	if idempotencyKeys == nil {
+		idempotencyKeys = make(map[string]IdempotencyRecord)
+	}
+	for id, rec := range loaded {
+		if _, ok := idempotencyKeys[id]; !ok {
+			idempotencyKeys[id] = rec
+		}
+	} // for
+	expireIdempotencyKeys()
+	log.Printf("info: Loaded %d Idempotency keys from disk.", len(idempotencyKeys))
+	return true
+} // func
+
+// ReleaseIdempotencyKey frees up a key whose message was never accepted, so that the
+// caller's retry isn't mistaken for a duplicate.
+func ReleaseIdempotencyKey(key string, idemKey string, msgId string) {
+	idempotencyLock.Lock()
+	defer idempotencyLock.Unlock()
+	id := key + "|" + idemKey
+	if rec, ok := idempotencyKeys[id]; ok && rec.MessageId == msgId {
+		delete(idempotencyKeys, id)
+	}
+} // func
+
+// expireIdempotencyKeys drops the keys that are past their window.  The caller must
+// be holding the lock.
+func expireIdempotencyKeys() {
+	now := time.Now().UTC()
+	for id, rec := range idempotencyKeys {
+		if now.After(rec.Expires) {
+			delete(idempotencyKeys, id)
+		}
+	} // for
+} // func
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message priorities.  Each one gets its own lane on the lists, and the more important
+// lanes are always emptied first.
+const (
+	PRIORITY_LOW    = 0
+	PRIORITY_NORMAL = 1
+	PRIORITY_HIGH   = 2
+	PRIORITY_URGENT = 3 // urgent actions only, like errors
+	PRIORITY_LANES  = 4
+)
+
+// Names of the priorities, indexed by lane.
+var PRIORITY_NAMES = []string{"low", "normal", "high", "urgent"}
+
+// InboundLanes is the inbound list, with a lane for each priority.
+type InboundLanes [PRIORITY_LANES]chan SlackMessageIn
+
+// OutboundLanes is a worker's outbound list, with a lane for each priority.  Each lane
+// has room for capacity posts of its own.  The lanes are made big enough to hold the
+// whole list, though, so a more important post can take the room of a shed one.
+type OutboundLanes struct {
+	lanes    [PRIORITY_LANES]chan SlackMessageOut
+	capacity int
+	room     chan bool // pinged whenever a post is taken off
+	held     *heldPosts
+	spill    *spilledPosts
+	drain    *DrainMeter // how fast the worker is taking posts off
+}
+
+// heldPosts are posts waiting for room in their lanes under the block policy.  They
+// wait here rather than holding up whoever queued them.
+type heldPosts struct {
+	lock  sync.Mutex
+	lanes [PRIORITY_LANES][]SlackMessageOut
+	count int
+	ready chan bool // pinged whenever a post is held
+}
+
+// QueueDepths is what the caller gets back when they ask how busy the lists are.
+type QueueDepths struct {
+	Capacity struct {
+		Inbound  int `json:"inbound"`
+		Outbound int `json:"outbound"`
+	} `json:"capacity"`
+	Inbound  map[string]int `json:"inbound"`
+	Outbound map[string]int `json:"outbound"`
+	Held     int            `json:"held"`
+	Spilled  int            `json:"spilled"`
+}
+
+// NewInboundLanes makes an inbound list where each lane holds up to capacity messages.
+func NewInboundLanes(capacity int) InboundLanes {
+	var lanes InboundLanes
+	for p := range lanes {
+		lanes[p] = make(chan SlackMessageIn, capacity)
+	} // for
+	return lanes
+} // func
+
+// Depths counts the messages waiting in each lane.
+func (lanes InboundLanes) Depths() [PRIORITY_LANES]int {
+	var depths [PRIORITY_LANES]int
+	for p := range lanes {
+		depths[p] = len(lanes[p])
+	} // for
+	return depths
+} // func
+
+// Len counts the messages waiting in all of the lanes.
+func (lanes InboundLanes) Len() int {
+	z := 0
+	for p := range lanes {
+		z += len(lanes[p])
+	} // for
+	return z
+} // func
+
+// Put adds the message to its lane, unless the lane is full.
+func (lanes InboundLanes) Put(doc SlackMessageIn) bool {
+	select {
+	case lanes[MessagePriority(doc.Priority, doc.Action, doc.Key)] <- doc:
+		return true
+	default:
+		return false
+	}
+} // func
+
+// PutWait adds the message to its lane, waiting for room if need be.
+func (lanes InboundLanes) PutWait(doc SlackMessageIn) {
+	lanes[MessagePriority(doc.Priority, doc.Action, doc.Key)] <- doc
+} // func
+
+// TryTake takes the oldest message from the most important lane that has one.
+func (lanes InboundLanes) TryTake() (SlackMessageIn, bool) {
+	for p := PRIORITY_URGENT; p >= PRIORITY_LOW; p-- {
+		select {
+		case doc := <-lanes[p]:
+			return doc, true
+		default:
+		}
+	} // for
+	return SlackMessageIn{}, false
+} // func
+
+// NewOutboundLanes makes an outbound list where each lane holds up to capacity posts.
+func NewOutboundLanes(capacity int) OutboundLanes {
+	ol := OutboundLanes{capacity: capacity, room: make(chan bool, 1)}
+	ol.held = &heldPosts{ready: make(chan bool, 1)}
+	ol.spill = &spilledPosts{}
+	ol.drain = &DrainMeter{}
+	for p := range ol.lanes {
+		ol.lanes[p] = make(chan SlackMessageOut, capacity*PRIORITY_LANES)
+	} // for
+	return ol
+} // func
+
+// Depths counts the posts waiting in each lane.
+func (ol OutboundLanes) Depths() [PRIORITY_LANES]int {
+	var depths [PRIORITY_LANES]int
+	for p := range ol.lanes {
+		depths[p] = len(ol.lanes[p])
+	} // for
+	return depths
+} // func
+
+// Evict makes room for a post of the given priority by taking the oldest post from the
+// least important lane below it that has one.
+func (ol OutboundLanes) Evict(priority int) (SlackMessageOut, bool) {
+	for p := PRIORITY_LOW; p < priority; p++ {
+		select {
+		case doc := <-ol.lanes[p]:
+			ol.freed()
+			return doc, true
+		default:
+		}
+	} // for
+	return SlackMessageOut{}, false
+} // func
+
+// Force adds the post to its lane even if the lane has used up its own room.  It is
+// only for a post taking the place of one that was just evicted.
+func (ol OutboundLanes) Force(doc SlackMessageOut) bool {
+	select {
+	case ol.lanes[MessagePriority(doc.Priority, doc.Action, doc.Key)] <- doc:
+		return true
+	default:
+		return false
+	}
+} // func
+
+// Len counts the posts waiting in all of the lanes.
+func (ol OutboundLanes) Len() int {
+	z := 0
+	for p := range ol.lanes {
+		z += len(ol.lanes[p])
+	} // for
+	return z
+} // func
+
+// Put adds the post to its lane, unless the lane is full.
+func (ol OutboundLanes) Put(doc SlackMessageOut) bool {
+	lane := ol.lanes[MessagePriority(doc.Priority, doc.Action, doc.Key)]
+	if len(lane) >= ol.capacity {
+		return false
+	}
+	select {
+	case lane <- doc:
+		return true
+	default:
+		return false
+	}
+} // func
+
+// Backlogged tells the caller if the list is holding as many posts as it has room for
+// in a lane, so new messages for it should wait.
+func (ol OutboundLanes) Backlogged() bool {
+	return ol.Held() >= ol.capacity
+} // func
+
+// RetryAfter estimates how many seconds it will take the worker to get through what is
+// on its list and held for it.
+func (ol OutboundLanes) RetryAfter() int {
+	return ol.drain.RetryAfter(ol.Len() + ol.Held())
+} // func
+
+// Feed moves held posts onto their lanes as room frees up.  It runs for as long as the
+// server does, one for each worker.
+func (ol OutboundLanes) Feed() {
+	for {
+		ol.feed()
+		select {
+		case <-ol.held.ready:
+		case <-ol.room:
+		}
+	} // for
+} // func
+
+// feed moves as many held posts onto their lanes as there is room for, most important
+// first.
+func (ol OutboundLanes) feed() {
+	ol.held.lock.Lock()
+	defer ol.held.lock.Unlock()
+	for p := PRIORITY_URGENT; p >= PRIORITY_LOW; p-- {
+		for len(ol.held.lanes[p]) > 0 && ol.Put(ol.held.lanes[p][0]) {
+			ol.held.lanes[p] = ol.held.lanes[p][1:]
+			ol.held.count--
+		} // for
+	} // for
+} // func
+
+// Held counts the posts waiting for room.
+func (ol OutboundLanes) Held() int {
+	ol.held.lock.Lock()
+	defer ol.held.lock.Unlock()
+	return ol.held.count
+} // func
+
+// Hold adds the post to its lane, or holds it until Feed finds room.  Once a lane has
+// posts held, new ones wait behind them so they go out in order.
+func (ol OutboundLanes) Hold(doc SlackMessageOut) {
+	p := MessagePriority(doc.Priority, doc.Action, doc.Key)
+	ol.held.lock.Lock()
+	defer ol.held.lock.Unlock()
+	if len(ol.held.lanes[p]) == 0 && ol.Put(doc) {
+		return
+	}
+	ol.held.lanes[p] = append(ol.held.lanes[p], doc)
+	ol.held.count++
+	select {
+	case ol.held.ready <- true:
+	default:
+	}
+} // func
+
+// Take waits for a post and returns the oldest one from the most important lane.
+func (ol OutboundLanes) Take() SlackMessageOut {
+	doc, _ := ol.take(nil)
+	return doc
+} // func
+
+// TakeBefore is Take, except that it gives up at the deadline.
+func (ol OutboundLanes) TakeBefore(deadline time.Time) (SlackMessageOut, bool) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	return ol.take(timer.C)
+} // func
+
+// TryTake takes the oldest post from the most important lane that has one.
+func (ol OutboundLanes) TryTake() (SlackMessageOut, bool) {
+	for p := PRIORITY_URGENT; p >= PRIORITY_LOW; p-- {
+		select {
+		case doc := <-ol.lanes[p]:
+			ol.drain.Mark(1)
+			ol.freed()
+			return doc, true
+		default:
+		}
+	} // for
+	return SlackMessageOut{}, false
+} // func
+
+// take waits for a post until the timeout fires.  A nil timeout waits for good.
+func (ol OutboundLanes) take(timeout <-chan time.Time) (SlackMessageOut, bool) {
+	if doc, ok := ol.TryTake(); ok {
+		return doc, true
+	}
+
+	// Nothing waiting, so take whatever shows up first.
+	var doc SlackMessageOut
+	select {
+	case doc = <-ol.lanes[PRIORITY_URGENT]:
+	case doc = <-ol.lanes[PRIORITY_HIGH]:
+	case doc = <-ol.lanes[PRIORITY_NORMAL]:
+	case doc = <-ol.lanes[PRIORITY_LOW]:
+	case <-timeout:
+		return doc, false
+	}
+	ol.drain.Mark(1)
+	ol.freed()
+	return doc, true
+} // func
+
+// freed lets Feed know there may be room now.
+func (ol OutboundLanes) freed() {
+	select {
+	case ol.room <- true:
+	default:
+	}
+} // func
+
+// GetQueueDepths reports how many messages are waiting in each lane of the lists.  The
+// outbound numbers are added up across the workers.
+func GetQueueDepths(rsp http.ResponseWriter) (int, string) {
+	var qd QueueDepths
+	qd.Capacity.Inbound = cap(InboundList[PRIORITY_LOW])
+	qd.Capacity.Outbound = OutboundList[0].capacity
+	qd.Inbound = make(map[string]int)
+	qd.Outbound = make(map[string]int)
+	inbound := InboundList.Depths()
+	for p, name := range PRIORITY_NAMES {
+		qd.Inbound[name] = inbound[p]
+		qd.Outbound[name] = 0
+	} // for
+	for _, lanes := range OutboundList {
+		qd.Held += lanes.Held()
+		qd.Spilled += lanes.Spilled()
+		outbound := lanes.Depths()
+		for p, name := range PRIORITY_NAMES {
+			qd.Outbound[name] += outbound[p]
+		} // for
+	} // for
+	return JsonResponse(rsp, http.StatusOK, qd)
+} // func
+
+// MessagePriority works out which lane a message goes in.  Urgent actions, like errors,
+// always go first.  Otherwise the priority the caller asked for wins over the one for
+// the action.
+func MessagePriority(priority string, action string, key string) int {
+	actionPriority := ActionPriority(action, GetSlacker(key))
+	if actionPriority == PRIORITY_URGENT {
+		return PRIORITY_URGENT
+	}
+	for p, name := range PRIORITY_NAMES[:PRIORITY_URGENT] {
+		if strings.EqualFold(priority, name) {
+			return p
+		}
+	} // for
+	return actionPriority
+} // func
+
+// ValidPriority tells the caller if the priority can be asked for.  Only actions are
+// urgent, so it can't be.
+func ValidPriority(priority string) bool {
+	for _, name := range PRIORITY_NAMES[:PRIORITY_URGENT] {
+		if strings.EqualFold(priority, name) {
+			return true
+		}
+	} // for
+	return false
+} // func
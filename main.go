@@ -13,48 +13,107 @@ import (
 
 // Determine current operating environment.
 var (
-	m                                 *martini.Martini
-	FlushTicker                       *time.Ticker
-	InboundList                       chan SlackMessageIn
-	OutboundList                      chan SlackMessageOut
-	InboundNotifier, OutboundNotifier chan bool
-	appConfig                         Config
-	body                              []byte
-	configFile                        string
-	err                               error
-	out                               []byte
-	systemKey                         string
-	apiv                              string
-)
-
-// Default icons for Slack posts.
-const (
-	ICON_ERROR   = "https://s3.amazonaws.com/centric-slack/cbot-error.png"
-	ICON_INFO    = "https://s3.amazonaws.com/centric-slack/cbot-info.png"
-	ICON_SUCCESS = "https://s3.amazonaws.com/centric-slack/cbot-success.png"
-	ICON_WARN    = "https://s3.amazonaws.com/centric-slack/cbot-warning.png"
+	m               *martini.Martini
+	FlushTicker     *time.Ticker
+	DispatchTicker  *time.Ticker
+	InboundList     InboundLanes
+	OutboundList    []OutboundLanes // one per worker
+	InboundNotifier chan bool
+	appConfig       Config
+	body            []byte
+	configFile      string
+	err             error
+	out             []byte
+	systemKey       string
+	apiv            string
 )
 
 // This is what the user sends in.
 type SlackMessageIn struct {
-	Key            string `json: "key"`
-	Action         string `json: "action"`
-	Text           string `json: "text"`
-	NotiftyOnError bool   `json: "notify_on_error"`
+	Id            string `json:"id"`
+	Key           string `json:"key"`
+	Action        string `json:"action"` // picks the icon, color and priority from the catalog
+	Text          string `json:"text"`
+	NotifyOnError bool   `json:"notify_on_error"`
+
+	// Sending the same key again within the window returns the first message's
+	// Id instead of posting twice.  The Idempotency-Key header works too.
+	IdempotencyKey string `json:"idempotency_key"`
+
+	// Hold the message until send_at (RFC 3339), or for delay_seconds.  A delay
+	// is turned into a send_at when the message is accepted.
+	SendAt       string `json:"send_at"`
+	DelaySeconds int    `json:"delay_seconds"`
+
+	// low, normal or high.  Without it the action decides, and urgent actions
+	// always go first.
+	Priority string `json:"priority"`
+
+	// A message still waiting ttl_seconds after it was accepted (or after its
+	// send_at) is stale and doesn't get sent.  Zero uses the slacker's default.
+	TTLSeconds int       `json:"ttl_seconds"`
+	Accepted   time.Time `json:"accepted"`
+
+	// Attachments without a color get one for the action.  Blocks are checked
+	// against the Block Kit rules and passed along as they are.
+	Attachments []Attachment      `json:"attachments"`
+	Blocks      []json.RawMessage `json:"blocks"`
+
+	// Values for the slacker's message template.
+	Vars map[string]interface{} `json:"vars"`
+
+	// plain, markdown or mrkdwn (the default).  Markdown is converted to mrkdwn.
+	Format string `json:"format"`
+
+	// Post somewhere other than the slacker's channel, or as someone else.  The
+	// channel has to be one of the slacker's allowed_channels.
+	Channel   string `json:"channel"`
+	UserName  string `json:"username"`
+	IconURL   string `json:"icon_url"`
+	IconEmoji string `json:"icon_emoji"`
 }
 
 // This is what gets sent to Slack.
 type SlackMessageOut struct {
-	Hook    string       `json:"hook"`
-	Payload SlackMessage `json: "payload"`
+	Id       string            `json:"id"`
+	Key      string            `json:"key"`
+	Action   string            `json:"action"`
+	Hook     string            `json:"hook"`
+	Payload  SlackMessage      `json:"payload"`
+	Attempts []DeliveryAttempt `json:"attempts"`
+	Priority string            `json:"priority"`
+	Expires  time.Time         `json:"expires"` // zero never expires
+
+	// Failures are reported to the slacker's error channel if they asked for it.
+	// Failures of those reports are only ever logged.
+	NotifyOnError  bool `json:"notify_on_error"`
+	IsNotification bool `json:"is_notification"`
 }
 
 // Some application conifugration settings.
 type Config struct {
-	AcceptingNewSlackers bool     `json:"accepting_new_slackers"`
-	AdminKey             string   `json:"admin_key"`
-	Domains              []string `json:"domains"`
-	TelemetriURL         string   `json:"telemetri_url"`
+	AcceptingNewSlackers     bool                 `json:"accepting_new_slackers"`
+	Actions                  map[string]ActionDef `json:"actions"` // the action catalog, over the built in actions
+	AdminKey                 string               `json:"admin_key"`
+	BreakerCooldownSeconds   int                  `json:"breaker_cooldown_seconds"` // wait before probing an open breaker, defaults 60
+	BreakerThreshold         int                  `json:"breaker_threshold"`        // failed messages in a row that open a breaker, defaults 5
+	ChannelBurst             int                  `json:"channel_burst"`            // posts a channel may send back to back
+	ChannelRate              float64              `json:"channel_rate"`             // posts per second per channel, 0 is unlimited
+	Domains                  []string             `json:"domains"`
+	IdempotencyWindowSeconds int                  `json:"idempotency_window_seconds"` // how long idempotency keys are remembered, defaults 3600
+	InboundCapacity          int                  `json:"inbound_capacity"`           // messages waiting to be processed per priority, defaults 100
+	HookBurst                int                  `json:"hook_burst"`                 // posts a hook may send back to back, defaults 1
+	HookRate                 float64              `json:"hook_rate"`                  // posts per second per hook, defaults 1
+	MaxAttempts              int                  `json:"max_attempts"`               // Slack posts before giving up, defaults 5
+	MaxTextLength            int                  `json:"max_text_length"`            // longest text in one post, 500 to 40000, defaults 4000
+	OutboundCapacity         int                  `json:"outbound_capacity"`          // messages waiting to be posted per priority and worker, defaults 100
+	OutboundFullPolicy       string               `json:"outbound_full_policy"`       // block, shed or spill, defaults block
+	OutboundWorkers          int                  `json:"outbound_workers"`           // delivery workers, defaults 4
+	PublicURL                string               `json:"public_url"`                 // where Spicoli can be reached, for links to full messages
+	RetryBaseMs              int                  `json:"retry_base_ms"`              // first retry delay, doubles each time
+	RetryMaxMs               int                  `json:"retry_max_ms"`               // cap on the retry delay
+	SlackTimeoutSeconds      int                  `json:"slack_timeout_seconds"`      // time limit on a Slack post, defaults 15
+	TelemetriURL             string               `json:"telemetri_url"`
 }
 
 // init runs before everything else.
@@ -64,6 +123,17 @@ func init() {
 	// Check credentials to make sure this is a legit request.
 	slackerFile = "slackers.json"
 	requestFile = "requests.json"
+	deadLetterFile = "deadletters.json"
+	deadLetterLog = "deadletters.log"
+	queueLogFile = "queue.log"
+	idempotencyFile = "idempotency.json"
+	scheduledFile = "scheduled.json"
+	recurringFile = "schedules.json"
+	templateFile = "templates.json"
+	directoryFile = "directory.json"
+	groupFile = "groups.json"
+	overflowDir = "overflow"
+	spillFile = "outbound.spill"
 
 	configFile = "config.json"
 	_, err := os.Stat(configFile)
@@ -74,12 +144,11 @@ func init() {
 		os.Exit(1)
 	}
 
-	// These are the background processes we need to keep track of.
-	InboundList = make(chan SlackMessageIn, 100)
-	OutboundList = make(chan SlackMessageOut, 100)
+	// These are the background processes we need to keep track of.  The lists
+	// themselves are sized from the config, so they are made in MakeQueues.
 	InboundNotifier = make(chan bool, 1)
-	OutboundNotifier = make(chan bool, 1)
 	FlushTicker = time.NewTicker(time.Minute * 1)
+	DispatchTicker = time.NewTicker(time.Second * 1)
 
 	// Set up the router.
 	m = martini.New()
@@ -90,11 +159,43 @@ func init() {
 	r.Put(`/slack/config/:key_id`, binding.Json(SlackConfig{}), UpdateSlacker)
 	r.Put(`/slack/config/:key_id/system`, AuthorizeAdmin, MakeSystemSlacker)
 	r.Delete(`/slack/config/:key_id`, DeleteSlacker)
+	r.Get(`/slack/config/:key_id/schedules`, ListRecurring)
+	r.Post(`/slack/config/:key_id/schedules`, binding.Json(RecurringSchedule{}), AddRecurring)
+	r.Get(`/slack/config/:key_id/schedules/:schedule_id`, GetRecurring)
+	r.Put(`/slack/config/:key_id/schedules/:schedule_id`, binding.Json(RecurringSchedule{}), UpdateRecurring)
+	r.Delete(`/slack/config/:key_id/schedules/:schedule_id`, DeleteRecurring)
 	r.Get(`/slack/configs`, GetSlackerCount)
+	r.Post(`/slack/groups`, binding.Json(SlackerGroup{}), AddGroup)
+	r.Get(`/slack/groups/:group_id`, GetGroup)
+	r.Put(`/slack/groups/:group_id`, AuthorizeAdmin, binding.Json(SlackerGroup{}), UpdateGroup)
+	r.Delete(`/slack/groups/:group_id`, AuthorizeAdmin, DeleteGroup)
 	r.Get(`/slack/request/:email`, RequestSlackerId)
 	r.Get(`/slack/requests`, GetRequestCount)
+	r.Get(`/slack/message/:message_id`, GetMessageStatus)
+	r.Get(`/slack/queues`, GetQueueDepths)
+	r.Get(`/slack/overflow/:overflow_id`, GetOverflow)
+	r.Get(`/slack/templates`, ListTemplates)
+	r.Post(`/slack/templates`, AuthorizeAdmin, binding.Json(MessageTemplate{}), AddTemplate)
+	r.Get(`/slack/templates/:template_id`, GetTemplate)
+	r.Put(`/slack/templates/:template_id`, AuthorizeAdmin, binding.Json(MessageTemplate{}), UpdateTemplate)
+	r.Delete(`/slack/templates/:template_id`, AuthorizeAdmin, DeleteTemplate)
+	r.Post(`/slack/templates/:template_id/render`, binding.Json(SlackMessageIn{}), RenderTemplate)
+	r.Get(`/slack/directory`, AuthorizeAdmin, ListDirectory)
+	r.Get(`/slack/directory/:name`, AuthorizeAdmin, GetDirectoryEntry)
+	r.Put(`/slack/directory/:name`, AuthorizeAdmin, binding.Json(DirectoryEntry{}), PutDirectoryEntry)
+	r.Delete(`/slack/directory/:name`, AuthorizeAdmin, DeleteDirectoryEntry)
+	r.Get(`/slack/scheduled/:key_id`, ListScheduled)
+	r.Delete(`/slack/scheduled/:key_id/:message_id`, CancelScheduled)
 	r.Get(`/slack/ping`, PingTheApi)
 	r.Get(`/slack/version`, GetSHPApiVersion)
+	r.Get(`/slack/deadletters`, AuthorizeAdmin, ListDeadLetters)
+	r.Post(`/slack/deadletters/replay`, AuthorizeAdmin, ReplayDeadLetters)
+	r.Delete(`/slack/deadletters`, AuthorizeAdmin, PurgeDeadLetters)
+	r.Get(`/slack/breakers`, AuthorizeAdmin, GetBreakers)
+	r.Delete(`/slack/breaker/:breaker_id`, AuthorizeAdmin, ResetBreaker)
+	r.Get(`/slack/deadletter/:letter_id`, AuthorizeAdmin, GetDeadLetter)
+	r.Post(`/slack/deadletter/:letter_id/replay`, AuthorizeAdmin, ReplayDeadLetter)
+	r.Delete(`/slack/deadletter/:letter_id`, AuthorizeAdmin, PurgeDeadLetter)
 	// Add the router action
 	m.Action(r.Handle)
 } // func
@@ -109,7 +210,6 @@ func AuthorizeAdmin(req *http.Request, rsp http.ResponseWriter) {
 	}
 } // func
 
-// 
 func AuthorizeUsr(req *http.Request, rsp http.ResponseWriter) {
 	// Make sure this is an admin request.
 	if req.Header.Get("SPICOLI-USER") != appConfig.AdminKey {
@@ -127,6 +227,17 @@ func PingTheApi() (int, string) {
 	return http.StatusOK, "PONG"
 } // func
 
+// JsonResponse encodes the value as the body of the response.
+func JsonResponse(rsp http.ResponseWriter, status int, v interface{}) (int, string) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("error: Could not encode response JSON/%s", err.Error())
+		return http.StatusInternalServerError, "JSON Error"
+	}
+	rsp.Header().Set("Content-Type", "application/json")
+	return status, string(buf)
+} // func
+
 // LoadConfig will read the configuration file and load the contents into a struct.
 func LoadConfig() bool {
 	// Check credentials to make sure this is a legit request.
@@ -147,6 +258,14 @@ func LoadConfig() bool {
 		log.Printf("error: Could not decode Config JSON/%s", err.Error())
 		return false
 	}
+	if !ValidMaxTextLength(appConfig.MaxTextLength) {
+		log.Printf("error: Ignoring max_text_length/must be between %d and %d", MIN_MAX_TEXT_LENGTH, MAX_MAX_TEXT_LENGTH)
+		appConfig.MaxTextLength = 0
+	}
+	if msg := ValidateActions(appConfig.Actions); msg != "" {
+		log.Printf("error: Ignoring action catalog/%s", msg)
+		appConfig.Actions = nil
+	}
 	log.Printf("info: Loaded config from disk.")
 	// Everything was cool, but the supplied key simply doesn't match anything.
 	return false
@@ -167,8 +286,23 @@ func main() {
 	log.Printf("Starting Spicoli version %s ...", apiv)
 	// Do an initial load of the JSON configuration files.
 	LoadConfig()
+	MakeQueues()
+	LoadTemplates()
+	LoadDirectory()
 	LoadSlackers()
+	LoadGroups()
 	LoadRequests()
+	LoadDeadLetters()
+	LoadIdempotencyKeys()
+	LoadScheduled()
+	LoadRecurring()
+	OpenQueueLog()
+	pending := PendingQueueLog()
+	ResetSpill()
+
+	// Outbound delivery runs on its own pool of workers so a slow Slack response
+	// only holds up the hooks that share its worker.
+	StartOutboundWorkers()
 
 	// Set up a background process to load the configs periodically so that
 	// new people can play and we can delete entries dynamicaclly.
@@ -177,17 +311,44 @@ func main() {
 			select {
 			case <-GetInboundNotifier():
 				DepleteInboundList()
-			case <-GetOutboundNotifier():
-				DepleteOutboundList()
+			case <-GetDispatchTicker():
+				ReleaseDigests()
+				ReleaseQuietHours()
+				ReleaseScheduled()
+				FireRecurring()
 			case <-GetFlushTicker():
 				FlushSlackers()
+				FlushGroups()
+				FlushTemplates()
+				FlushDirectory()
 				FlushRequests()
+				FlushDeadLetters()
+				FlushIdempotencyKeys()
+				FlushScheduled()
+				FlushRecurring()
 				LoadSlackers()
+				LoadGroups()
+				LoadTemplates()
+				LoadDirectory()
 				LoadRequests()
+				LoadDeadLetters()
+				LoadIdempotencyKeys()
+				LoadScheduled()
+				LoadRecurring()
+				PruneMessageStatuses()
+				PruneOverflow()
+				CompactQueueLog()
+				RefillFromSpill()
 			}
 		}
 	}()
 
+	// Anything accepted but not delivered before the last shutdown is put back on the
+	// lists.  A big backlog can take a while to find room, so it happens alongside
+	// taking new messages rather than keeping the server from listening.  What to
+	// replay was settled when the log was opened, so nothing logged since is replayed.
+	go ReplayQueueLog(pending)
+
 	// Let's go!  You can change the listening port to whatever you want.
 	m.RunOnAddr(":1966")
 } // func
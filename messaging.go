@@ -1,85 +1,140 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"github.com/pborman/uuid"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // DepleteInboundList will run through the all of the inbound Slack requests and process them for output.
-// When done they are loaded on the output list.
+// When done they are loaded on the output list.  The most important ones go first.
 func DepleteInboundList() {
-	var sout SlackMessageOut
-
-	z := len(InboundList)
+	z := InboundList.Len()
+	defer inboundDrain.Mark(z)
 	for i := 0; i < z; i++ {
-		doc := <-InboundList
-		// We have good parms, so let's make sure the key is good before doing any real work.
-		scfg := GetSlacker(doc.Key)
-		if scfg.Key != "" {
-			// Load up the outbound message for Slack.
-			sout.Payload.UserName = scfg.SlackData.UserName
-			// We will use the Icon URL if it is specified.  If not, use the build it
-			// based on the Action.
-			switch doc.Action {
-			case "info":
-				sout.Payload.IconURL = ICON_INFO
-			case "error":
-				sout.Payload.IconURL = ICON_ERROR
-			case "success":
-				sout.Payload.IconURL = ICON_SUCCESS
-			case "warn":
-				sout.Payload.IconURL = ICON_WARN
-			default:
-				sout.Payload.IconURL = scfg.SlackData.IconURL
-			} // switch
-
-			sout.Hook = scfg.Hook
-			sout.Payload.IconEmoji = scfg.SlackData.IconEmoji
-			sout.Payload.Channel = scfg.SlackData.Channel
-			// Now load up the text.
-			sout.Payload.Text = doc.Text
-
-			// OK, prep for sending out to Slack.  If we can't, send an error
-			// to the error channel.
-			if !FillOutboundList(sout) {
-				log.Printf("error: Outbound list is full")
-				// TODO: Send out to system channel.
-			}
-			log.Printf("%s queued to outbound", doc.Key)
-		} else {
-			log.Printf("error: Could not find key")
-			// TODO: Send an error to the error channel.
-		} // else
+		doc, ok := InboundList.TryTake()
+		if !ok {
+			break
+		}
+		ProcessInbound(doc)
 	} // for
 } // func
 
-// DepleteOutboundList will take everything queued from the inbound side and send
-// them out.
-func DepleteOutboundList() {
-	z := len(OutboundList)
-	for i := 0; i < z; i++ {
-		doc := <-OutboundList
-		// Convert to HTTP-needs so we can send the message out.
-		body, err = json.Marshal(doc.Payload)
-		if err != nil {
-			log.Printf("error: Could not marshal payload/%s", err.Error())
-			//return http.StatusBadRequest, "JSON Error"
-		}
-		req, err := http.NewRequest("POST", doc.Hook, bytes.NewBuffer(body))
+// ProcessInbound matches the message up with its slacker and, unless it is being held
+// back for later, quiet hours or a digest, turns it into a Slack post.
+func ProcessInbound(doc SlackMessageIn) {
+	// We have good parms, so let's make sure the key is good before doing any real work.
+	scfg := GetSlacker(doc.Key)
+	if scfg.Key == "" {
+		log.Printf("error: Could not find key")
+		AddUnknownKeyLetter(doc)
+		return
+	}
+	if !scfg.IsActive() {
+		log.Printf("error: Slacker %s is not active", SlackerLabel(scfg, doc.Key))
+		AddDeadLetter("Slacker is not active", doc.Key, &doc, nil)
+		return
+	}
+	// The allowed channels may have changed since the message was accepted.
+	if doc.Channel != "" && !scfg.AllowsChannel(doc.Channel) {
+		log.Printf("error: Slacker %s may not post to %s", SlackerLabel(scfg, doc.Key), doc.Channel)
+		AddDeadLetter("Channel is not allowed", doc.Key, &doc, nil)
+		return
+	}
+	if expires := ExpiresAt(doc, scfg); IsExpired(expires) {
+		ExpireInbound(doc, scfg, expires)
+		return
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("error: Could not connect to Slack/%s", err.Error())
-		}
-		defer resp.Body.Close()
-		log.Printf("sent to channel %s", doc.Payload.Channel)
-	} // for
+	// Messages for later wait on the schedule.
+	if DueTime(doc).After(time.Now()) {
+		ScheduleMessage(doc)
+		return
+	}
+
+	// Lay out the text, mentions and all, so anything held back is held the way it will look.
+	doc = ResolveMentions(FormatMessage(RenderMessage(doc, scfg)))
+
+	// Nothing but the allowed actions gets through during quiet hours.
+	if HoldForQuietHours(doc, scfg) {
+		SetMessageState(doc.Id, STATE_HELD, "Held for quiet hours")
+		return
+	}
+
+	// A slacker sending too much too fast gets a digest instead.
+	if CoalesceMessage(doc, scfg) {
+		SetMessageState(doc.Id, STATE_HELD, "Held for digest")
+		return
+	}
+	PostMessage(doc, scfg)
+} // func
+
+// BuildOutbound turns an inbound message into the post that goes to Slack.
+func BuildOutbound(doc SlackMessageIn, scfg SlackConfig) SlackMessageOut {
+	var sout SlackMessageOut
+
+	// Load up the outbound message for Slack.  The action's icons win over the
+	// slacker's own.
+	def := LookupAction(doc.Action, scfg)
+	sout.Payload.UserName = scfg.SlackData.UserName
+	sout.Payload.IconURL = def.IconURL
+	if sout.Payload.IconURL == "" {
+		sout.Payload.IconURL = scfg.SlackData.IconURL
+	}
+	sout.Payload.IconEmoji = def.IconEmoji
+	if sout.Payload.IconEmoji == "" {
+		sout.Payload.IconEmoji = scfg.SlackData.IconEmoji
+	}
+
+	sout.Id = doc.Id
+	sout.Key = doc.Key
+	sout.Action = doc.Action
+	sout.Priority = doc.Priority
+	sout.Expires = ExpiresAt(doc, scfg)
+	sout.NotifyOnError = doc.NotifyOnError
+	sout.Hook = scfg.Hook
+	sout.Payload.Channel = scfg.SlackData.Channel
+	// The message can pick its own look, and any channel the slacker allows.
+	if doc.UserName != "" {
+		sout.Payload.UserName = doc.UserName
+	}
+	if doc.IconURL != "" || doc.IconEmoji != "" {
+		sout.Payload.IconURL = doc.IconURL
+		sout.Payload.IconEmoji = doc.IconEmoji
+	}
+	if doc.Channel != "" {
+		sout.Payload.Channel = doc.Channel
+	}
+	// Now load up the text.
+	sout.Payload.Text = doc.Text
+	if doc.Format == FORMAT_PLAIN {
+		mrkdwn := false
+		sout.Payload.Mrkdwn = &mrkdwn
+	}
+	sout.Payload.Attachments = BuildAttachments(doc, scfg)
+	sout.Payload.Blocks = doc.Blocks
+	// Slack wants text with blocks for notifications, so borrow some from them.
+	if sout.Payload.Text == "" {
+		sout.Payload.Text = BlocksText(doc.Blocks)
+	}
+	if def.Prefix != "" {
+		sout.Payload.Text = strings.TrimSpace(def.Prefix + " " + sout.Payload.Text)
+	}
+	return sout
 } // func
 
+// SendOutbound records the post in the queue log and puts it on the outbound list.
+// If that doesn't work out, the dead letter will send an error to the error channel.
+func SendOutbound(sout SlackMessageOut) {
+	if err := LogOutbound(sout); err != nil {
+		log.Printf("error: Could not write to queue log/%s", err.Error())
+	}
+	QueueOutbound(sout)
+	log.Printf("%s queued to outbound", sout.Key)
+} // func
 
 // Functions for reading and pushing notifications for the inbound Slack requests.
 func GetInboundNotifier() chan bool {
@@ -93,57 +148,166 @@ func NotifyInboundList() {
 	}
 }
 func FillInboundList(smi SlackMessageIn) bool {
-	// Make sure there is room in the list before adding any thing to it.
-	if len(InboundList) < cap(InboundList) {
-		InboundList <- smi
+	// Make sure there is room in the lane before adding any thing to it.  Requests
+	// come in concurrently, so checking the length first isn't enough.
+	if InboundList.Put(smi) {
 		NotifyInboundList()
 		return true
 	}
 	return false
 }
 
-// Functions for reading and pushing notifications for the outbound Slack posts.
-func GetOutboundNotifier() chan bool {
-	return OutboundNotifier
+// FillOutboundList puts a message on the outbound list of the worker that owns its hook.
+func FillOutboundList(smo SlackMessageOut) bool {
+	// Make sure there is room in the lane before adding any thing to it.  The workers
+	// are always draining it, so don't wait around if it's full.
+	return OutboundList[ShardFor(smo.Hook)].Put(smo)
 }
-func NotifyOutboundList() {
-	// Since this is only a "call to action" channel, it only needs one call.
-	// If there is already a message in it, then someone else made that call.
-	if len(OutboundNotifier) < cap(OutboundNotifier) {
-		OutboundNotifier <- true
-	}
+
+// HoldOutboundList puts a message on the outbound list, or holds it until there is room.
+// Only the worker that owns its hook is held up.
+func HoldOutboundList(smo SlackMessageOut) {
+	OutboundList[ShardFor(smo.Hook)].Hold(smo)
 }
-func FillOutboundList(smo SlackMessageOut) bool {
-	// Make sure there is room in the list before adding any thing to it.
-	if len(OutboundList) < cap(OutboundList) {
-		OutboundList <- smo
-		NotifyOutboundList()
-		return true
+
+// MakeQueues sets up the inbound list and an outbound list for each worker, at the
+// sizes given in config.json.
+func MakeQueues() {
+	inCap, outCap := appConfig.InboundCapacity, appConfig.OutboundCapacity
+	if inCap <= 0 {
+		inCap = DEFAULT_INBOUND_CAPACITY
 	}
-	return false
-}
+	if outCap <= 0 {
+		outCap = DEFAULT_OUTBOUND_CAPACITY
+	}
+	n := appConfig.OutboundWorkers
+	if n <= 0 {
+		n = DEFAULT_OUTBOUND_WORKERS
+	}
+	InboundList = NewInboundLanes(inCap)
+	OutboundList = make([]OutboundLanes, n)
+	for i := range OutboundList {
+		OutboundList[i] = NewOutboundLanes(outCap)
+		OutboundList[i].spill.file = spillFile + "." + strconv.Itoa(i)
+	} // for
+} // func
 
 // Ticker for flushing and reloading the config file.
 func GetFlushTicker() <-chan time.Time {
 	return FlushTicker.C
 }
 
-//
-func PushToSlack(smi SlackMessageIn) (int, string) {
+// Ticker for releasing messages that have been held back.
+func GetDispatchTicker() <-chan time.Time {
+	return DispatchTicker.C
+}
+
+func PushToSlack(smi SlackMessageIn, req *http.Request, rsp http.ResponseWriter) (int, string) {
 	// Make sure we have a good set of parameters before we go anywhere.
 	if smi.Key == "" {
 		return http.StatusBadRequest, "Key not provided.  Have you registered?"
 	}
 
-	// We need text.  Otherwise, what's the point?
-	if smi.Text == "" {
+	// We need text, attachments or blocks.  Otherwise, what's the point?
+	if smi.Text == "" && len(smi.Attachments) == 0 && len(smi.Blocks) == 0 {
 		return http.StatusBadRequest, "Slack text not provided.  What do you want me to say?"
 	}
+	if msg := ValidateAttachments(smi.Attachments); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	if msg := ValidateBlocks(smi.Blocks); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+
+	// A group key sends the message to each of the group's slackers, so it has to
+	// suit all of them.
+	group := FindGroup(smi.Key)
+	members := []SlackConfig{GetSlacker(smi.Key)}
+	if group.Key != "" {
+		members = GroupMembers(group)
+	}
+	for _, scfg := range members {
+		if !KnownAction(smi.Action, scfg) {
+			return http.StatusBadRequest, "Unknown action " + smi.Action + "."
+		}
+		if smi.Channel != "" && !scfg.AllowsChannel(smi.Channel) {
+			return http.StatusForbidden, "This slacker may not post to " + smi.Channel + "."
+		}
+	} // for
+	if smi.Priority != "" && !ValidPriority(smi.Priority) {
+		return http.StatusBadRequest, "priority must be low, normal or high."
+	}
+
+	if !ValidFormat(smi.Format) {
+		return http.StatusBadRequest, "format must be plain, markdown or mrkdwn."
+	}
+	if smi.TTLSeconds < 0 {
+		return http.StatusBadRequest, "ttl_seconds can't be negative."
+	}
+
+	// If it's meant for later, work out exactly when.
+	if smi.SendAt != "" && smi.DelaySeconds != 0 {
+		return http.StatusBadRequest, "Use send_at or delay_seconds, not both."
+	}
+	if smi.DelaySeconds < 0 {
+		return http.StatusBadRequest, "delay_seconds can't be negative."
+	}
+	if smi.SendAt != "" {
+		if _, err := time.Parse(time.RFC3339, smi.SendAt); err != nil {
+			return http.StatusBadRequest, "send_at must be an RFC 3339 timestamp."
+		}
+	}
+	if smi.DelaySeconds > 0 {
+		smi.SendAt = time.Now().UTC().Add(time.Duration(smi.DelaySeconds) * time.Second).Format(time.RFC3339)
+		smi.DelaySeconds = 0
+	}
+
+	// Under the block policy a worker that can't keep up holds the posts for its hooks.
+	// Once it is holding a lane's worth, new messages for those hooks have to wait.
+	for _, scfg := range members {
+		if lanes := OutboundList[ShardFor(scfg.Hook)]; lanes.Backlogged() {
+			rsp.Header().Set("Retry-After", strconv.Itoa(lanes.RetryAfter()))
+			return http.StatusServiceUnavailable, "Outbound list is full, try again later."
+		}
+	} // for
 
 	// The basics look good, throw it on the list to be processed in the background.
+	// The Id lets the caller check on the message later.
+	smi.Id = uuid.New()
+	smi.Accepted = time.Now().UTC()
+
+	// If the caller has sent this one before, give them the same answer as the first
+	// time rather than posting it again.
+	if smi.IdempotencyKey == "" {
+		smi.IdempotencyKey = req.Header.Get("Idempotency-Key")
+	}
+	if smi.IdempotencyKey != "" {
+		if firstId, claimed := ClaimIdempotencyKey(smi.Key, smi.IdempotencyKey, smi.Id); !claimed {
+			log.Printf("info: Duplicate of message %s ignored", firstId)
+			return JsonResponse(rsp, http.StatusAccepted, Receipt{Id: firstId, Status: "Accepted", Legs: MessageLegs(firstId)})
+		}
+	}
+	if group.Key != "" {
+		return FanOut(smi, group, rsp)
+	}
+
+	TrackMessage(smi.Id)
+	// Accepted has to mean accepted, so the message is on disk before we say so.
+	if err := LogInbound(smi); err != nil {
+		log.Printf("error: Could not write to queue log/%s", err.Error())
+		SetMessageState(smi.Id, STATE_FAILED, "Could not persist message")
+		ReleaseIdempotencyKey(smi.Key, smi.IdempotencyKey, smi.Id)
+		return http.StatusInternalServerError, "Could not persist message."
+	}
 	if FillInboundList(smi) {
 		// We've accepted the message.  There's another process for notifying the user of issues.
-		return http.StatusAccepted, "Accepted"
+		return JsonResponse(rsp, http.StatusAccepted, Receipt{Id: smi.Id, Status: "Accepted"})
 	}
-	return http.StatusBadRequest, "Inbound list is full."
+	ReleaseIdempotencyKey(smi.Key, smi.IdempotencyKey, smi.Id)
+	SetMessageState(smi.Id, STATE_FAILED, "Inbound list is full")
+	LogDone(smi.Id)
+	NotifyFailure(smi.Key, smi.NotifyOnError, smi.Id, "Inbound list is full")
+	// This isn't the caller's fault, so tell them when it's worth trying again.
+	rsp.Header().Set("Retry-After", strconv.Itoa(inboundDrain.RetryAfter(InboundList.Len())))
+	return http.StatusServiceUnavailable, "Inbound list is full, try again later."
 } // func
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pborman/uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+// The same notice is only sent once in this window.  A hook that is down would
+// otherwise bury the error channel.
+const NOTIFY_THROTTLE = time.Minute
+
+var (
+	notifySent map[string]time.Time
+	notifyLock sync.Mutex
+)
+
+// NotifyFailure tells the slacker's error channel that one of their messages failed,
+// if they asked to be told, and tells the system slacker in any case.
+func NotifyFailure(key string, notifyOwner bool, msgId string, reason string) {
+	scfg := GetSlacker(key)
+	if notifyOwner && scfg.Key != "" && scfg.ErrorChannel != "" {
+		SendNotification(scfg, scfg.ErrorChannel, fmt.Sprintf("Message %s could not be delivered/%s", msgId, reason))
+	}
+	// The system notice leaves out the message Id so that a run of failures for the
+	// same reason is throttled down to one notice.
+	NotifySystem(fmt.Sprintf("A message from %s could not be delivered/%s", SlackerLabel(scfg, key), reason))
+} // func
+
+// NotifySystem posts an operational notice to the system slacker, if there is one.
+func NotifySystem(text string) {
+	scfg := GetSystemSlacker()
+	if scfg.Key == "" {
+		return
+	}
+	channel := scfg.ErrorChannel
+	if channel == "" {
+		channel = scfg.SlackData.Channel
+	}
+	SendNotification(scfg, channel, text)
+} // func
+
+// SendNotification puts a notice straight on the outbound list.  Notices are marked
+// so that if one fails it is only logged, which keeps a broken hook from setting off
+// an endless chain of notices about notices.
+func SendNotification(scfg SlackConfig, channel string, text string) {
+	notifyLock.Lock()
+	if notifySent == nil {
+		notifySent = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for sig, sent := range notifySent {
+		if now.Sub(sent) > NOTIFY_THROTTLE {
+			delete(notifySent, sig)
+		}
+	} // for
+	sig := scfg.Hook + "|" + channel + "|" + text
+	_, seen := notifySent[sig]
+	if !seen {
+		notifySent[sig] = now
+	}
+	notifyLock.Unlock()
+	if seen {
+		return
+	}
+
+	var sout SlackMessageOut
+	sout.Id = uuid.New()
+	sout.Key = scfg.Key
+	sout.Action = "error"
+	sout.Hook = scfg.Hook
+	sout.IsNotification = true
+	sout.Payload.UserName = scfg.SlackData.UserName
+	def := LookupAction("error", scfg)
+	sout.Payload.IconURL = def.IconURL
+	sout.Payload.IconEmoji = def.IconEmoji
+	sout.Payload.Channel = channel
+	sout.Payload.Text = text
+	// Never wait on a full list here.  This gets called from the workers that empty it.
+	if !FillOutboundList(sout) {
+		log.Printf("error: Outbound list is full, dropped notice/%s", text)
+	}
+} // func
+
+// SlackerLabel names a slacker in notices without giving away its key.
+func SlackerLabel(scfg SlackConfig, key string) string {
+	if scfg.Name != "" {
+		return scfg.Name
+	}
+	if len(key) > 8 {
+		return key[:8] + "..."
+	}
+	return key
+} // func
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/pborman/uuid"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// What to do with text that is too long for one post.
+const (
+	OVERSIZE_SPLIT    = "split"    // send it as numbered posts, the default
+	OVERSIZE_TRUNCATE = "truncate" // cut it short and link to the full copy
+)
+
+// Oversize defaults and limits.
+const (
+	DEFAULT_MAX_TEXT_LENGTH = 4000
+	MIN_MAX_TEXT_LENGTH     = 500   // leaves room for part labels, prefixes and links
+	MAX_MAX_TEXT_LENGTH     = 40000 // Slack cuts off anything longer
+	MIN_PART_LENGTH         = 100   // no piece is cut shorter, whatever the room left
+	OVERFLOW_RETENTION      = 7 * 24 * time.Hour
+	PART_LABEL_ROOM         = 12 // room for the "(12/34) " on each part
+	CODE_FENCE              = "```"
+)
+
+var (
+	overflowDir string
+)
+
+// GetOverflow serves the full copy of a message that was cut short.
+func GetOverflow(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	id := params["overflow_id"]
+	if uuid.Parse(id) == nil {
+		return http.StatusNotFound, "Message does not exist."
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(overflowDir, id+".txt"))
+	if err != nil {
+		return http.StatusNotFound, "Message does not exist."
+	}
+	rsp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	return http.StatusOK, string(buf)
+} // func
+
+// MaxTextLength is the longest text that goes out in a single post.
+func MaxTextLength() int {
+	if appConfig.MaxTextLength > 0 {
+		return appConfig.MaxTextLength
+	}
+	return DEFAULT_MAX_TEXT_LENGTH
+} // func
+
+// PostMessage sends the message to Slack, splitting or truncating its text first if it
+// is too long for one post.
+func PostMessage(doc SlackMessageIn, scfg SlackConfig) {
+	for _, part := range FitMessage(doc, scfg) {
+		SendOutbound(BuildOutbound(part, scfg))
+	} // for
+} // func
+
+// FitMessage makes sure the text of the message fits in a post, following the slacker's
+// oversize mode.  Truncating needs a public_url to link to, and splits without one.
+// Room is left for the action's prefix.
+func FitMessage(doc SlackMessageIn, scfg SlackConfig) []SlackMessageIn {
+	limit := MaxTextLength()
+	if prefix := LookupAction(doc.Action, scfg).Prefix; prefix != "" {
+		limit -= utf8.RuneCountInString(prefix) + 1
+	}
+	if utf8.RuneCountInString(doc.Text) <= limit {
+		return []SlackMessageIn{doc}
+	}
+
+	if scfg.OversizeMode == OVERSIZE_TRUNCATE {
+		if appConfig.PublicURL == "" {
+			log.Printf("error: Can't truncate without a public_url, splitting instead")
+		} else if text, err := truncateText(doc.Text, limit); err != nil {
+			log.Printf("error: Could not store full message/%s", err.Error())
+		} else {
+			doc.Text = text
+			return []SlackMessageIn{doc}
+		}
+	}
+
+	texts := SplitText(doc.Text, limit-PART_LABEL_ROOM)
+	if len(texts) < 2 {
+		// Nothing but blank lines, which isn't worth splitting.
+		return []SlackMessageIn{doc}
+	}
+	parts := make([]SlackMessageIn, len(texts))
+	for i, text := range texts {
+		part := doc
+		part.Text = fmt.Sprintf("(%d/%d) %s", i+1, len(texts), text)
+		if i > 0 {
+			part.Id = fmt.Sprintf("%s-%d", doc.Id, i+1)
+			TrackMessage(part.Id)
+		}
+		// Attachments and blocks show up under the text, so they go with the last part.
+		if i < len(texts)-1 {
+			part.Attachments = nil
+			part.Blocks = nil
+		}
+		parts[i] = part
+	} // for
+	log.Printf("info: Split message %s into %d parts", doc.Id, len(parts))
+	return parts
+} // func
+
+// PruneOverflow removes stored copies that are past keeping.
+func PruneOverflow() {
+	files, err := ioutil.ReadDir(overflowDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error: Unable to read overflow directory/%s", err.Error())
+		}
+		return
+	}
+	cutoff := time.Now().Add(-OVERFLOW_RETENTION)
+	for _, file := range files {
+		if file.ModTime().Before(cutoff) {
+			if err = os.Remove(filepath.Join(overflowDir, file.Name())); err != nil {
+				log.Printf("error: Could not remove overflow file/%s", err.Error())
+			}
+		}
+	} // for
+} // func
+
+// SplitText breaks the text into pieces no longer than the limit.  Breaks are made
+// between lines wherever possible, and never inside a code block.  A code block that
+// is too long by itself is closed at the end of one piece and opened again in the next.
+// A limit below MIN_PART_LENGTH is raised to it, so a post may run a little long but
+// the text is never cut into nothing.
+func SplitText(text string, limit int) []string {
+	if limit < MIN_PART_LENGTH {
+		limit = MIN_PART_LENGTH
+	}
+	pieces := []string{}
+	current := ""
+	for _, unit := range textUnits(text, limit) {
+		if current != "" && utf8.RuneCountInString(current)+utf8.RuneCountInString(unit) > limit {
+			pieces = append(pieces, strings.TrimRight(current, "\n"))
+			current = ""
+		}
+		current += unit
+	} // for
+	if strings.TrimSpace(current) != "" {
+		pieces = append(pieces, strings.TrimRight(current, "\n"))
+	}
+	return pieces
+} // func
+
+// ValidMaxTextLength tells the caller if the max_text_length can be used.  Zero is the
+// default.
+func ValidMaxTextLength(length int) bool {
+	return length == 0 || (length >= MIN_MAX_TEXT_LENGTH && length <= MAX_MAX_TEXT_LENGTH)
+} // func
+
+// ValidOversizeMode tells the caller if the mode is one we know.  Empty is the default.
+func ValidOversizeMode(mode string) bool {
+	switch mode {
+	case "", OVERSIZE_SPLIT, OVERSIZE_TRUNCATE:
+		return true
+	}
+	return false
+} // func
+
+// cutText cuts off as much of the text as fits in the limit.  It tries to cut at a
+// space, and never cuts an escaped character in half.
+func cutText(text string, limit int) (string, string) {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text, ""
+	}
+	cut := limit
+	// An escape is at most five characters long (&amp;).
+	for i := cut - 1; i >= 0 && i >= cut-4; i-- {
+		if runes[i] == ';' {
+			break
+		}
+		if runes[i] == '&' {
+			if i > 0 {
+				cut = i
+			}
+			break
+		}
+	} // for
+	for i := cut; i > limit/2; i-- {
+		if runes[i-1] == ' ' {
+			cut = i
+			break
+		}
+	} // for
+	return string(runes[:cut]), string(runes[cut:])
+} // func
+
+// storeOverflow saves the full text of a message so it can be served later.  What is
+// saved is unescaped, since it is served as plain text.
+func storeOverflow(text string) (string, error) {
+	if err := os.MkdirAll(overflowDir, 0755); err != nil {
+		return "", err
+	}
+	id := uuid.New()
+	unescaped := strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+	if err := ioutil.WriteFile(filepath.Join(overflowDir, id+".txt"), []byte(unescaped), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+} // func
+
+// textUnits breaks the text into the pieces that can't be split any further: whole
+// lines, and whole code blocks.  Anything longer than the limit is split anyway, code
+// blocks by line and lines by length.
+func textUnits(text string, limit int) []string {
+	units := []string{}
+	lines := strings.SplitAfter(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !strings.HasPrefix(strings.TrimSpace(line), CODE_FENCE) {
+			units = append(units, splitLine(line, limit)...)
+			continue
+		}
+
+		// Gather up the whole code block, fences and all.
+		block := []string{line}
+		for i+1 < len(lines) {
+			i++
+			block = append(block, lines[i])
+			if strings.HasPrefix(strings.TrimSpace(lines[i]), CODE_FENCE) {
+				break
+			}
+		} // for
+		whole := strings.Join(block, "")
+		if utf8.RuneCountInString(whole) <= limit {
+			units = append(units, whole)
+			continue
+		}
+
+		// Too big, so rewrap the inside in fences of its own for each piece.
+		inner := block[1:]
+		if len(inner) > 0 && strings.HasPrefix(strings.TrimSpace(inner[len(inner)-1]), CODE_FENCE) {
+			inner = inner[:len(inner)-1]
+		}
+		room := limit - 2*(len(CODE_FENCE)+1)
+		current := ""
+		for _, codeLine := range inner {
+			for _, piece := range splitLine(codeLine, room) {
+				if current != "" && utf8.RuneCountInString(current)+utf8.RuneCountInString(piece) > room {
+					units = append(units, CODE_FENCE+"\n"+current+CODE_FENCE+"\n")
+					current = ""
+				}
+				current += piece
+				if !strings.HasSuffix(current, "\n") {
+					current += "\n"
+				}
+			} // for
+		} // for
+		if current != "" {
+			units = append(units, CODE_FENCE+"\n"+current+CODE_FENCE+"\n")
+		}
+	} // for
+	return units
+} // func
+
+// splitLine splits a line that is longer than the limit.
+func splitLine(line string, limit int) []string {
+	pieces := []string{}
+	for utf8.RuneCountInString(line) > limit {
+		piece, rest := cutText(line, limit)
+		pieces = append(pieces, piece+"\n")
+		line = rest
+	} // for
+	if line != "" {
+		pieces = append(pieces, line)
+	}
+	return pieces
+} // func
+
+// truncateText cuts the text down to size and links to a stored copy of all of it.
+func truncateText(text string, limit int) (string, error) {
+	id, err := storeOverflow(text)
+	if err != nil {
+		return "", err
+	}
+	link := fmt.Sprintf("\n…\n<%s/slack/overflow/%s|See the full message>", strings.TrimRight(appConfig.PublicURL, "/"), id)
+	head := ""
+	if pieces := SplitText(text, limit-utf8.RuneCountInString(link)); len(pieces) > 0 {
+		head = pieces[0]
+	}
+	return head + link, nil
+} // func
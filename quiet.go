@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Quiet holds are only ever touched from the background loop, so they need no lock.
+var (
+	quietHolds map[string][]SlackMessageIn
+)
+
+// QuietHours keeps a slacker from posting at times when people would rather not be
+// woken up.  Only the actions listed in AllowActions get through during a window.
+type QuietHours struct {
+	Windows      []QuietWindow `json:"windows"`
+	TimeZone     string        `json:"time_zone"`     // defaults UTC
+	AllowActions []string      `json:"allow_actions"` // for example ["error"]
+}
+
+// QuietWindow is a span of the day given as "HH:MM" clock times.  A window whose end
+// is before its start runs past midnight.
+type QuietWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Allows tells the caller if the action may be posted during quiet hours.
+func (qh QuietHours) Allows(action string) bool {
+	for _, allowed := range qh.AllowActions {
+		if strings.EqualFold(allowed, action) {
+			return true
+		}
+	} // for
+	return false
+} // func
+
+// IsQuiet tells the caller if the given time falls in one of the windows.
+func (qh QuietHours) IsQuiet(t time.Time) bool {
+	if len(qh.Windows) == 0 {
+		return false
+	}
+	loc := time.UTC
+	if qh.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(qh.TimeZone); err != nil {
+			return false
+		}
+	}
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	for _, w := range qh.Windows {
+		start, errStart := clockMinutes(w.Start)
+		end, errEnd := clockMinutes(w.End)
+		if errStart != nil || errEnd != nil {
+			continue
+		}
+		if start <= end && now >= start && now < end {
+			return true
+		}
+		if start > end && (now >= start || now < end) {
+			return true
+		}
+	} // for
+	return false
+} // func
+
+// Validate returns what is wrong with the quiet hours, if anything.
+func (qh QuietHours) Validate() string {
+	if qh.TimeZone != "" {
+		if _, err := time.LoadLocation(qh.TimeZone); err != nil {
+			return "Unknown quiet hours time zone " + qh.TimeZone + "."
+		}
+	}
+	for _, w := range qh.Windows {
+		if _, err := clockMinutes(w.Start); err != nil {
+			return "Quiet hours start must look like 22:00."
+		}
+		if _, err := clockMinutes(w.End); err != nil {
+			return "Quiet hours end must look like 07:00."
+		}
+	} // for
+	return ""
+} // func
+
+// HoldForQuietHours decides whether the message has to wait out the slacker's quiet
+// hours, and holds on to it if so.
+func HoldForQuietHours(doc SlackMessageIn, scfg SlackConfig) bool {
+	if !scfg.QuietHours.IsQuiet(time.Now()) || scfg.QuietHours.Allows(doc.Action) {
+		return false
+	}
+	if quietHolds == nil {
+		quietHolds = make(map[string][]SlackMessageIn)
+	}
+	quietHolds[scfg.Key] = append(quietHolds[scfg.Key], doc)
+	return true
+} // func
+
+// ReleaseQuietHours posts what was held for every slacker whose quiet hours are over.
+// A lone message goes out as it was sent, more than one goes out as a summary for each
+// channel.
+func ReleaseQuietHours() {
+	now := time.Now()
+	for key, held := range quietHolds {
+		scfg := GetSlacker(key)
+		if scfg.Key != "" && scfg.IsActive() && scfg.QuietHours.IsQuiet(now) {
+			continue
+		}
+		delete(quietHolds, key)
+		releaseHeld(key, scfg, held, "*%d messages held during quiet hours*", "Merged into quiet hours summary ", true)
+	} // for
+} // func
+
+// clockMinutes turns an "HH:MM" clock time into minutes past midnight.
+func clockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+} // func
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Slack allows roughly one post per second on an incoming webhook.
+const (
+	DEFAULT_HOOK_RATE  = 1.0
+	DEFAULT_HOOK_BURST = 1
+)
+
+var (
+	limiters    map[string]*TokenBucket
+	limiterLock sync.Mutex
+)
+
+// A TokenBucket hands out Rate tokens per second and holds at most Burst of them.
+// Tokens are allowed to go negative so that callers line up behind one another
+// instead of being turned away.
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{Rate: rate, Burst: float64(burst), tokens: float64(burst)}
+} // func
+
+// Reserve takes a token and returns how long the caller has to wait before it can
+// be used.
+func (b *TokenBucket) Reserve(now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+} // func
+
+// getLimiter returns the bucket for the given name, making one if this is the first
+// time we've seen it.  The caller must be holding the lock.
+func getLimiter(name string, rate float64, burst int) *TokenBucket {
+	if limiters == nil {
+		limiters = make(map[string]*TokenBucket)
+	}
+	bucket, ok := limiters[name]
+	if !ok {
+		bucket = NewTokenBucket(rate, burst)
+		limiters[name] = bucket
+	}
+	return bucket
+} // func
+
+// ReserveSlot works out how long the message has to wait before it can go out.  Every
+// hook has a limit, and if config.json sets a channel rate each channel on a hook
+// gets its own limit as well.
+func ReserveSlot(doc SlackMessageOut) time.Duration {
+	rate, burst := appConfig.HookRate, appConfig.HookBurst
+	if rate <= 0 {
+		rate = DEFAULT_HOOK_RATE
+	}
+	if burst <= 0 {
+		burst = DEFAULT_HOOK_BURST
+	}
+
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	now := time.Now()
+	wait := getLimiter(doc.Hook, rate, burst).Reserve(now)
+	if appConfig.ChannelRate > 0 && doc.Payload.Channel != "" {
+		name := doc.Hook + "|" + doc.Payload.Channel
+		if w := getLimiter(name, appConfig.ChannelRate, appConfig.ChannelBurst).Reserve(now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+} // func
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/go-martini/martini"
+	"github.com/pborman/uuid"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How far ahead to look for the next run before giving up on a cron expression that
+// can never match (the 31st of February, say).
+const CRON_SEARCH_YEARS = 5
+
+// The hour field of a schedule that runs every hour.
+const CRON_ALL_HOURS = 1<<24 - 1
+
+var (
+	recurringFile string
+	recurring     map[string]RecurringSchedule
+	recurringLock sync.Mutex
+)
+
+// RecurringSchedule is a message the slacker wants posted over and over, on a cron
+// schedule in its own time zone.
+type RecurringSchedule struct {
+	Id       string    `json:"id"`
+	Key      string    `json:"key"`
+	Cron     string    `json:"cron"`      // minute hour day-of-month month day-of-week
+	TimeZone string    `json:"time_zone"` // defaults UTC
+	Action   string    `json:"action"`
+	Text     string    `json:"text"`
+	NextRun  time.Time `json:"next_run"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+}
+
+// CronSpec is a parsed cron expression.  Each field is a bit set of the values it
+// matches.
+type CronSpec struct {
+	Minute, Hour, Dom, Month, Dow uint64
+	// The day fields are OR'd together when both are restricted, same as cron.
+	DomAny, DowAny bool
+}
+
+// matchesDay tells the caller if the spec matches the day of the given time.
+func (cs CronSpec) matchesDay(t time.Time) bool {
+	dom := cs.Dom&(1<<uint(t.Day())) != 0
+	dow := cs.Dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case cs.DomAny && cs.DowAny:
+		return true
+	case cs.DomAny:
+		return dow
+	case cs.DowAny:
+		return dom
+	}
+	return dom || dow
+} // func
+
+// Next returns the first time after t that the spec matches, in t's location.
+func (cs CronSpec) Next(t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(CRON_SEARCH_YEARS, 0, 0)
+	for t.Before(limit) {
+		if cs.Month&(1<<uint(t.Month())) == 0 {
+			t = skipTo(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !cs.matchesDay(t) {
+			t = skipTo(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		// A schedule for set hours runs once in the hour repeated when daylight saving
+		// time ends, same as cron.
+		if cs.Hour&(1<<uint(t.Hour())) == 0 || (cs.Hour != CRON_ALL_HOURS && repeatedHour(t)) {
+			// Count the minutes rather than asking for the next hour by its clock time,
+			// which might not exist when daylight saving time starts.
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if cs.Minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	} // for
+	return time.Time{}, false
+} // func
+
+// repeatedHour tells the caller if t is in the second pass through an hour that is
+// repeated when daylight saving time ends.
+func repeatedHour(t time.Time) bool {
+	earlier := t.Add(-time.Hour)
+	return earlier.Hour() == t.Hour() && earlier.Day() == t.Day()
+} // func
+
+// skipTo moves on to the next time, unless a daylight saving change has put the next
+// time behind us.  Then it goes forward an hour instead so the search keeps moving.
+func skipTo(t time.Time, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Hour)
+} // func
+
+// ParseCron reads a standard five field cron expression.  Each field takes *, a number,
+// a range (1-5), a list (1,3,5) and a step (*/15 or 0-30/10).  Sunday is 0 or 7.
+func ParseCron(expr string) (CronSpec, error) {
+	var cs CronSpec
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cs, errors.New("cron needs five fields: minute hour day-of-month month day-of-week")
+	}
+	var err error
+	if cs.Minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return cs, errors.New("minute: " + err.Error())
+	}
+	if cs.Hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return cs, errors.New("hour: " + err.Error())
+	}
+	if cs.Dom, cs.DomAny, err = parseCronField(fields[2], 1, 31); err != nil {
+		return cs, errors.New("day-of-month: " + err.Error())
+	}
+	if cs.Month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return cs, errors.New("month: " + err.Error())
+	}
+	if cs.Dow, cs.DowAny, err = parseCronField(fields[4], 0, 7); err != nil {
+		return cs, errors.New("day-of-week: " + err.Error())
+	}
+	if cs.Dow&(1<<7) != 0 {
+		cs.Dow |= 1
+	}
+	return cs, nil
+} // func
+
+// parseCronField turns one field of a cron expression into a bit set.  It also reports
+// whether the field was a bare *.
+func parseCronField(field string, min int, max int) (uint64, bool, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, false, errors.New("bad step in " + part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			ends := strings.SplitN(part, "-", 2)
+			a, errA := strconv.Atoi(ends[0])
+			b, errB := strconv.Atoi(ends[1])
+			if errA != nil || errB != nil {
+				return 0, false, errors.New("bad range " + part)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, false, errors.New("bad value " + part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, false, errors.New(part + " is out of range")
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		} // for
+	} // for
+	return bits, field == "*", nil
+} // func
+
+// AddRecurring attaches a new recurring schedule to the slacker.
+func AddRecurring(rs RecurringSchedule, params martini.Params, rsp http.ResponseWriter) (int, string) {
+	if !ValidateSlacker(params["key_id"]) {
+		return http.StatusBadRequest, "Slacker does not exist."
+	}
+	rs.Id = uuid.New()
+	rs.Key = params["key_id"]
+	rs.LastRun = time.Time{}
+	if msg := prepareRecurring(&rs); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+
+	recurringLock.Lock()
+	if recurring == nil {
+		recurring = make(map[string]RecurringSchedule)
+	}
+	recurring[rs.Id] = rs
+	writeRecurring()
+	recurringLock.Unlock()
+	return JsonResponse(rsp, http.StatusCreated, rs)
+} // func
+
+// DeleteRecurring removes a recurring schedule from the slacker.
+func DeleteRecurring(params martini.Params) (int, string) {
+	recurringLock.Lock()
+	defer recurringLock.Unlock()
+	rs, ok := recurring[params["schedule_id"]]
+	if !ok || rs.Key != params["key_id"] {
+		return http.StatusNotFound, "Schedule does not exist."
+	}
+	delete(recurring, rs.Id)
+	writeRecurring()
+	return http.StatusOK, "Schedule deleted."
+} // func
+
+// FireRecurring posts every recurring message that has come due, then works out when
+// each one runs next.  If the server was down through several runs, only one post is
+// made for them.
+func FireRecurring() {
+	now := time.Now()
+	recurringLock.Lock()
+	due := []RecurringSchedule{}
+	changed := false
+	for id, rs := range recurring {
+		if rs.NextRun.IsZero() || now.Before(rs.NextRun) {
+			continue
+		}
+		changed = true
+		scfg := GetSlacker(rs.Key)
+		if scfg.Key == "" {
+			// The slacker is gone, so its schedules go with it.
+			delete(recurring, id)
+			continue
+		}
+		// A slacker that has been turned off just skips the run.
+		if scfg.IsActive() {
+			due = append(due, rs)
+			rs.LastRun = now.UTC()
+		}
+		rs.NextRun = nextRecurringRun(rs, now)
+		recurring[id] = rs
+	} // for
+	if changed {
+		writeRecurring()
+	}
+	recurringLock.Unlock()
+
+	for _, rs := range due {
+		doc := SlackMessageIn{Id: uuid.New(), Key: rs.Key, Action: rs.Action, Text: rs.Text, Accepted: now.UTC()}
+		TrackMessage(doc.Id)
+		if err := LogInbound(doc); err != nil {
+			log.Printf("error: Could not write to queue log/%s", err.Error())
+		}
+		log.Printf("info: Recurring schedule %s fired as message %s", rs.Id, doc.Id)
+		ProcessInbound(doc)
+	} // for
+} // func
+
+// FlushRecurring will write the recurring schedules to disk.
+func FlushRecurring() {
+	recurringLock.Lock()
+	defer recurringLock.Unlock()
+	writeRecurring()
+} // func
+
+// GetRecurring returns one of the slacker's recurring schedules.
+func GetRecurring(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	recurringLock.Lock()
+	rs, ok := recurring[params["schedule_id"]]
+	recurringLock.Unlock()
+	if !ok || rs.Key != params["key_id"] {
+		return http.StatusNotFound, "Schedule does not exist."
+	}
+	return JsonResponse(rsp, http.StatusOK, rs)
+} // func
+
+// ListRecurring returns the slacker's recurring schedules, next to run first.
+func ListRecurring(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	if !ValidateSlacker(params["key_id"]) {
+		return http.StatusBadRequest, "Slacker does not exist."
+	}
+	recurringLock.Lock()
+	list := []RecurringSchedule{}
+	for _, rs := range recurring {
+		if rs.Key == params["key_id"] {
+			list = append(list, rs)
+		}
+	} // for
+	recurringLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NextRun.Before(list[j].NextRun)
+	})
+	return JsonResponse(rsp, http.StatusOK, list)
+} // func
+
+// LoadRecurring reads the recurring schedules from disk.
+func LoadRecurring() bool {
+	file, err := os.Open(recurringFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	loaded := make(map[string]RecurringSchedule)
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&loaded)
+	if err != nil {
+		log.Printf("error: Could not decode Schedules JSON/%s", err.Error())
+		return false
+	}
+	recurringLock.Lock()
+	defer recurringLock.Unlock()
+	recurring = loaded
+	log.Printf("info: Loaded %d Schedules from disk.", len(recurring))
+	return true
+} // func
+
+// UpdateRecurring replaces the cron, time zone and message of a recurring schedule.
+func UpdateRecurring(rs RecurringSchedule, params martini.Params, rsp http.ResponseWriter) (int, string) {
+	recurringLock.Lock()
+	defer recurringLock.Unlock()
+	old, ok := recurring[params["schedule_id"]]
+	if !ok || old.Key != params["key_id"] {
+		return http.StatusNotFound, "Schedule does not exist."
+	}
+	rs.Id = old.Id
+	rs.Key = old.Key
+	rs.LastRun = old.LastRun
+	if msg := prepareRecurring(&rs); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	recurring[rs.Id] = rs
+	writeRecurring()
+	return JsonResponse(rsp, http.StatusOK, rs)
+} // func
+
+// nextRecurringRun works out when the schedule runs next after the given time.  A
+// schedule that can't be worked out gets a zero time and never runs.
+func nextRecurringRun(rs RecurringSchedule, after time.Time) time.Time {
+	cs, err := ParseCron(rs.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	loc := time.UTC
+	if rs.TimeZone != "" {
+		if loc, err = time.LoadLocation(rs.TimeZone); err != nil {
+			return time.Time{}
+		}
+	}
+	next, ok := cs.Next(after.In(loc))
+	if !ok {
+		return time.Time{}
+	}
+	return next.UTC()
+} // func
+
+// prepareRecurring checks a schedule sent in by the owner and works out its first run.
+// It returns what is wrong with it, if anything.
+func prepareRecurring(rs *RecurringSchedule) string {
+	if rs.Text == "" {
+		return "Schedule text not provided.  What do you want me to say?"
+	}
+	if !KnownAction(rs.Action, GetSlacker(rs.Key)) {
+		return "Unknown action " + rs.Action + "."
+	}
+	if _, err := ParseCron(rs.Cron); err != nil {
+		return "Bad cron expression, " + err.Error() + "."
+	}
+	if rs.TimeZone != "" {
+		if _, err := time.LoadLocation(rs.TimeZone); err != nil {
+			return "Unknown time zone " + rs.TimeZone + "."
+		}
+	}
+	rs.NextRun = nextRecurringRun(*rs, time.Now())
+	if rs.NextRun.IsZero() {
+		return "Cron expression never matches."
+	}
+	return ""
+} // func
+
+// writeRecurring does the actual work of saving the schedules.  The caller must be
+// holding the lock.
+func writeRecurring() {
+	file, err := os.Create(recurringFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	// Let's make the JSON pretty.
+	buf, err := json.MarshalIndent(recurring, "", "  ")
+	if err != nil {
+		log.Printf("error: Could not encode Schedules JSON/%s", err.Error())
+		return
+	}
+
+	// Now output the lot.
+	out := bytes.NewBuffer(buf)
+	_, err = out.WriteTo(file)
+	if err != nil {
+		log.Printf("error: Could not write to buffer/%s", err.Error())
+	}
+} // func
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry policy defaults used when config.json does not override them.
+const (
+	DEFAULT_MAX_ATTEMPTS  = 5
+	DEFAULT_RETRY_BASE_MS = 500
+	DEFAULT_RETRY_MAX_MS  = 60000
+)
+
+var (
+	slackClient = &http.Client{}
+)
+
+// DeliveryAttempt records the outcome of a single post to a Slack hook.
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code"`
+	Response   string    `json:"response"`
+	Error      string    `json:"error"`
+}
+
+// Succeeded tells the caller if Slack accepted the post.
+func (a DeliveryAttempt) Succeeded() bool {
+	return a.StatusCode >= 200 && a.StatusCode < 300
+} // func
+
+// Retryable tells the caller if the failure is one that might go away on its own.
+// Connection problems, throttling and server side errors are worth another try.
+// Anything else in the 4xx range means Slack will never take the message.
+func (a DeliveryAttempt) Retryable() bool {
+	if a.StatusCode == 0 {
+		return a.Error != ""
+	}
+	return a.StatusCode == http.StatusTooManyRequests || a.StatusCode >= 500
+} // func
+
+// AttemptDelivery makes attempt n at posting the message to its hook and records it on
+// the message, so the caller knows what happened.  If the post failed but is worth
+// another try, it also returns how long to back off first.  Otherwise the message is
+// finished with and the wait is zero.
+func AttemptDelivery(doc *SlackMessageOut, n int) (bool, time.Duration) {
+	max := GetMaxAttempts()
+	SetMessageState(doc.Id, STATE_SENDING, "")
+	attempt, retryAfter := PostToSlack(*doc)
+	doc.Attempts = append(doc.Attempts, attempt)
+	if attempt.Succeeded() {
+		RecordAttempt(doc.Id, attempt, STATE_DELIVERED)
+		return true, 0
+	}
+	if !attempt.Retryable() || n >= max {
+		RecordAttempt(doc.Id, attempt, STATE_FAILED)
+		return false, 0
+	}
+	RecordAttempt(doc.Id, attempt, STATE_RETRYING)
+
+	wait := RetryDelay(n, retryAfter)
+	log.Printf("warn: Post to channel %s failed (%d %s), retry %d of %d in %s",
+		doc.Payload.Channel, attempt.StatusCode, attempt.Error, n, max-1, wait)
+	return false, wait
+} // func
+
+// DeliveryFailure describes why the last attempt on a message failed.
+func DeliveryFailure(doc SlackMessageOut) string {
+	if len(doc.Attempts) == 0 {
+		return "Never attempted"
+	}
+	last := doc.Attempts[len(doc.Attempts)-1]
+	if last.StatusCode == 0 {
+		return fmt.Sprintf("Gave up after %d attempts/%s", len(doc.Attempts), last.Error)
+	}
+	return fmt.Sprintf("Gave up after %d attempts/%d %s", len(doc.Attempts), last.StatusCode, last.Response)
+} // func
+
+// GetMaxAttempts returns the number of times a message is tried before giving up.
+func GetMaxAttempts() int {
+	if appConfig.MaxAttempts > 0 {
+		return appConfig.MaxAttempts
+	}
+	return DEFAULT_MAX_ATTEMPTS
+} // func
+
+// ParseRetryAfter converts a Retry-After header into a duration.  Slack sends the
+// number of seconds, but the HTTP date form is honored as well.
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := when.Sub(time.Now()); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+} // func
+
+// PostToSlack makes a single attempt at sending the message to its hook.  Along
+// with the attempt it returns how long Slack asked us to wait, if it asked at all.
+func PostToSlack(doc SlackMessageOut) (DeliveryAttempt, time.Duration) {
+	attempt := DeliveryAttempt{Time: time.Now().UTC()}
+
+	// Convert to HTTP-needs so we can send the message out.
+	buf, err := json.Marshal(doc.Payload)
+	if err != nil {
+		log.Printf("error: Could not marshal payload/%s", err.Error())
+		attempt.StatusCode = http.StatusBadRequest
+		attempt.Error = err.Error()
+		return attempt, 0
+	}
+	req, err := http.NewRequest("POST", doc.Hook, bytes.NewBuffer(buf))
+	if err != nil {
+		log.Printf("error: Could not build Slack request/%s", err.Error())
+		attempt.StatusCode = http.StatusBadRequest
+		attempt.Error = err.Error()
+		return attempt, 0
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		log.Printf("error: Could not connect to Slack/%s", err.Error())
+		attempt.Error = err.Error()
+		return attempt, 0
+	}
+	defer resp.Body.Close()
+
+	// Slack explains itself in the body ("invalid_payload", "no_service", etc.), so
+	// hang on to a little of it.
+	text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = string(text)
+
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter = ParseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return attempt, retryAfter
+} // func
+
+// RetryDelay works out how long to wait before the next attempt.  A Retry-After from
+// Slack wins, up to the longest delay.  Otherwise the delay doubles with each attempt,
+// is capped, and is jittered so a batch of failures doesn't come back all at once.
+func RetryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	base := time.Duration(DEFAULT_RETRY_BASE_MS) * time.Millisecond
+	if appConfig.RetryBaseMs > 0 {
+		base = time.Duration(appConfig.RetryBaseMs) * time.Millisecond
+	}
+	max := time.Duration(DEFAULT_RETRY_MAX_MS) * time.Millisecond
+	if appConfig.RetryMaxMs > 0 {
+		max = time.Duration(appConfig.RetryMaxMs) * time.Millisecond
+	}
+	if retryAfter > max {
+		return max
+	}
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	delay := max
+	if attempt < 31 {
+		if d := base << uint(attempt-1); d > 0 && d < max {
+			delay = d
+		}
+	}
+	// Keep at least half of the delay and randomize the rest.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+} // func
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	scheduledFile string
+	scheduled     map[string]SlackMessageIn
+	scheduledLock sync.Mutex
+)
+
+// CancelScheduled takes a pending message off the schedule.  The message has to belong
+// to the slacker whose key is in the path.
+func CancelScheduled(params martini.Params) (int, string) {
+	scheduledLock.Lock()
+	defer scheduledLock.Unlock()
+	doc, ok := scheduled[params["message_id"]]
+	if !ok || doc.Key != params["key_id"] {
+		return http.StatusNotFound, "Scheduled message does not exist."
+	}
+	delete(scheduled, doc.Id)
+	if err := writeScheduled(); err != nil {
+		log.Printf("error: Could not save Scheduled messages/%s", err.Error())
+	}
+	SetMessageState(doc.Id, STATE_CANCELLED, "Cancelled by owner")
+	return http.StatusOK, "Scheduled message cancelled."
+} // func
+
+// DueTime returns when the message should go out.  Messages without a send_at are due
+// right away.
+func DueTime(doc SlackMessageIn) time.Time {
+	if doc.SendAt == "" {
+		return time.Time{}
+	}
+	due, err := time.Parse(time.RFC3339, doc.SendAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return due
+} // func
+
+// FlushScheduled will write the scheduled messages to disk.
+func FlushScheduled() {
+	scheduledLock.Lock()
+	defer scheduledLock.Unlock()
+	if err := writeScheduled(); err != nil {
+		log.Printf("error: Could not save Scheduled messages/%s", err.Error())
+	}
+} // func
+
+// writeScheduled does the actual work of saving the schedule.  The new file is written
+// off to the side and renamed over the old one, so a crash part way through never
+// leaves a broken schedule.  The caller must be holding the lock.
+func writeScheduled() error {
+	// Let's make the JSON pretty.
+	buf, err := json.MarshalIndent(scheduled, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := scheduledFile + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	_, err = bytes.NewBuffer(buf).WriteTo(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, scheduledFile)
+} // func
+
+// ListScheduled returns the slacker's pending messages, soonest first.
+func ListScheduled(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	if !ValidateSlacker(params["key_id"]) {
+		return http.StatusBadRequest, "Slacker does not exist."
+	}
+	scheduledLock.Lock()
+	list := []SlackMessageIn{}
+	for _, doc := range scheduled {
+		if doc.Key == params["key_id"] {
+			list = append(list, doc)
+		}
+	} // for
+	scheduledLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return DueTime(list[i]).Before(DueTime(list[j]))
+	})
+	return JsonResponse(rsp, http.StatusOK, list)
+} // func
+
+// LoadScheduled reads the scheduled messages from disk.
+func LoadScheduled() bool {
+	file, err := os.Open(scheduledFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	loaded := make(map[string]SlackMessageIn)
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&loaded)
+	if err != nil {
+		log.Printf("error: Could not decode Scheduled JSON/%s", err.Error())
+		return false
+	}
+	scheduledLock.Lock()
+	defer scheduledLock.Unlock()
+	scheduled = loaded
+	log.Printf("info: Loaded %d Scheduled messages from disk.", len(scheduled))
+	return true
+} // func
+
+// ReleaseScheduled sends every scheduled message that has come due.  Each one goes
+// back in the queue log before it comes off the schedule so it can't be lost in
+// between.
+func ReleaseScheduled() {
+	now := time.Now()
+	scheduledLock.Lock()
+	due := []SlackMessageIn{}
+	for _, doc := range scheduled {
+		if !now.Before(DueTime(doc)) {
+			due = append(due, doc)
+		}
+	} // for
+	scheduledLock.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return DueTime(due[i]).Before(DueTime(due[j]))
+	})
+	for _, doc := range due {
+		if err := LogInbound(doc); err != nil {
+			log.Printf("error: Could not write to queue log/%s", err.Error())
+			continue
+		}
+		scheduledLock.Lock()
+		delete(scheduled, doc.Id)
+		if err := writeScheduled(); err != nil {
+			log.Printf("error: Could not save Scheduled messages/%s", err.Error())
+		}
+		scheduledLock.Unlock()
+		ProcessInbound(doc)
+	} // for
+} // func
+
+// ScheduleMessage holds the message until it is due.  Once the schedule is on disk the
+// message no longer needs to be in the queue log.  Until then it stays there, so a
+// crash before the next save can't lose it.
+func ScheduleMessage(doc SlackMessageIn) {
+	scheduledLock.Lock()
+	if scheduled == nil {
+		scheduled = make(map[string]SlackMessageIn)
+	}
+	scheduled[doc.Id] = doc
+	err := writeScheduled()
+	scheduledLock.Unlock()
+
+	SetMessageState(doc.Id, STATE_SCHEDULED, "Scheduled for "+doc.SendAt)
+	if err != nil {
+		log.Printf("error: Could not save Scheduled messages/%s", err.Error())
+		return
+	}
+	LogDone(doc.Id)
+} // func
@@ -8,24 +8,53 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 var (
 	slackerFile string
 	slackers    map[string]SlackConfig
+	slackerLock sync.RWMutex
 )
 
 type SlackConfig struct {
 	Key               string       `json:"key"`                 // reqd
 	Name              string       `json:"name"`                // descriptive name
 	UseTelemetri      bool         `json:"use_telemetri"`       // future, defaults false
-	MessageTemplateId string       `json:"message_template_id"` // future
+	MessageTemplateId string       `json:"message_template_id"` // lays out the text, see /slack/templates
 	Action            string       `json:"action"`              // Success, Error, Warning, Info
-	IsActive          bool         `json:"is_active"`           // future, defaults true
+	Active            *bool        `json:"is_active,omitempty"` // defaults true, turned off when Slack says the hook is gone
 	Hook              string       `json:"hook"`                // reqd
 	IsSystem          bool         `json:"is_system"`           // future, defaults false
 	ErrorChannel      string       `json:"error_channel"`       // If populated, errors get sent here
 	SlackData         SlackMessage `json:"slack_data"`
+
+	// More than CoalesceThreshold messages within the window and the rest of the
+	// window's messages go out as one digest.  Zero turns it off.
+	CoalesceThreshold     int `json:"coalesce_threshold"`
+	CoalesceWindowSeconds int `json:"coalesce_window_seconds"` // defaults 60
+
+	// Messages sent during quiet hours are held until the window ends.
+	QuietHours QuietHours `json:"quiet_hours"`
+
+	// Messages without a ttl_seconds of their own get this one.  Stale messages
+	// are dead lettered unless DropExpired is set.
+	DefaultTTLSeconds int  `json:"default_ttl_seconds"`
+	DropExpired       bool `json:"drop_expired"`
+
+	// Actions of the slacker's own, and changes to the catalog's, such as a
+	// different icon for errors.  Colors is the older way to set their colors.
+	Actions map[string]ActionDef `json:"actions"`
+	Colors  map[string]string    `json:"colors"`
+
+	// Text too long for one post is split into numbered posts, or truncated with
+	// a link to the full copy.
+	OversizeMode string `json:"oversize_mode"` // split or truncate, defaults split
+
+	// Channels a message may pick instead of the slacker's own, so a leaked key
+	// can't be used to post just anywhere.
+	AllowedChannels []string `json:"allowed_channels"`
 }
 
 type SlackMessage struct {
@@ -34,8 +63,35 @@ type SlackMessage struct {
 	IconEmoji string `json:"icon_emoji"` // Overrides emoji assigned to hook
 	Channel   string `json:"channel"`    // "#other-channel; @username"
 	Text      string `json:"text"`       // more for outbound use, may be used as canned text later
+
+	Mrkdwn      *bool             `json:"mrkdwn,omitempty"`      // outbound only, false for plain text
+	Attachments []Attachment      `json:"attachments,omitempty"` // outbound only
+	Blocks      []json.RawMessage `json:"blocks,omitempty"`      // outbound only
 }
 
+// IsActive tells the caller if the slacker may post.  Slackers are active unless they
+// have been turned off, which keeps slackers saved before there was a way to turn them
+// off working.
+func (sc SlackConfig) IsActive() bool {
+	return sc.Active == nil || *sc.Active
+} // func
+
+// AllowsChannel tells the caller if a message may be sent to the channel.  The slacker's
+// own channel is always allowed.  Names are compared without the # and regardless of
+// case, since Slack channel names are lower case anyway.
+func (sc SlackConfig) AllowsChannel(channel string) bool {
+	name := strings.TrimPrefix(channel, "#")
+	if strings.EqualFold(name, strings.TrimPrefix(sc.SlackData.Channel, "#")) {
+		return true
+	}
+	for _, allowed := range sc.AllowedChannels {
+		if strings.EqualFold(name, strings.TrimPrefix(allowed, "#")) {
+			return true
+		}
+	} // for
+	return false
+} // func
+
 // AddSlacker will validate a new configuration record, then add it to the in-memory
 // map which will then be persisted to disk.
 func AddSlacker(sc SlackConfig) (int, string) {
@@ -43,6 +99,8 @@ func AddSlacker(sc SlackConfig) (int, string) {
 	if !ValidateRequest(sc.Key) {
 		return http.StatusBadRequest, "UUID is invalid."
 	}
+	slackerLock.Lock()
+	defer slackerLock.Unlock()
 	// Make sure the uuid does not already exist.
 	if slackers[sc.Key].Key != "" {
 		return http.StatusBadRequest, "UUID already exists."
@@ -51,31 +109,71 @@ func AddSlacker(sc SlackConfig) (int, string) {
 	if sc.Hook == "" {
 		return http.StatusBadRequest, "You need a Slack hook to receive the messages."
 	}
+	if msg := validateSlackerConfig(sc); msg != "" {
+		return http.StatusBadRequest, msg
+	}
 
 	// Everything looks good, add the item to the slacker map.  Then delete the request
-	// record from the map.
+	// record from the map.  New slackers always start out active.
+	sc.Active = nil
 	slackers[sc.Key] = sc
 	DeleteRequest(sc.Key)
 
 	return http.StatusOK, "New config record added."
 } // func
 
+// DeactivateSlackers turns off every active slacker posting to the hook, or only those
+// posting to the given channel on it.  Channels are compared the way AllowsChannel
+// compares them.  It returns the slackers it turned off.
+func DeactivateSlackers(hook string, channel string) []SlackConfig {
+	slackerLock.Lock()
+	defer slackerLock.Unlock()
+	list := []SlackConfig{}
+	for key, value := range slackers {
+		if value.Hook != hook || !value.IsActive() {
+			continue
+		}
+		if channel != "" && !strings.EqualFold(strings.TrimPrefix(value.SlackData.Channel, "#"), strings.TrimPrefix(channel, "#")) {
+			continue
+		}
+		active := false
+		value.Active = &active
+		slackers[key] = value
+		list = append(list, value)
+	} // for
+	return list
+} // func
+
 // DeleteSlacker will delete the specified slacker key from the map.  The map is what
 // drives the slacker file so on the next write operation, the slacker file will
 // simply persist without the deleted key.
 func DeleteSlacker(params martini.Params) (int, string) {
+	slackerLock.Lock()
+	defer slackerLock.Unlock()
 	delete(slackers, params["key_id"])
 	return http.StatusOK, "Slacker record deleted."
 } // func
 
 // GetSlacker retrieves the slacker structure based on the provided Id.
 func GetSlacker(id string) SlackConfig {
+	slackerLock.RLock()
+	defer slackerLock.RUnlock()
 	slacker := slackers[id]
 	return slacker
 } // func
 
+// GetSystemSlacker retrieves the slacker that system notices are sent to.  The Key is
+// empty if there isn't one.
+func GetSystemSlacker() SlackConfig {
+	slackerLock.RLock()
+	defer slackerLock.RUnlock()
+	return slackers[systemKey]
+} // func
+
 // GetSlackerCount returns the current number of slacker structs being served.
 func GetSlackerCount() (int, string) {
+	slackerLock.RLock()
+	defer slackerLock.RUnlock()
 	return http.StatusOK, strconv.Itoa(len(slackers))
 } // func
 
@@ -88,6 +186,8 @@ func FlushSlackers() {
 	defer file.Close()
 
 	// Let's make the JSON pretty.
+	slackerLock.RLock()
+	defer slackerLock.RUnlock()
 	buf, err := json.MarshalIndent(slackers, "", "  ")
 	if err != nil {
 		log.Printf("error: Unable to encode JSON file/%s", err.Error())
@@ -118,16 +218,19 @@ func LoadSlackers() bool {
 
 	// Allocate memory for the map.  We use this map to lookup configurations
 	// when sending out Slack posts.
-	slackers = make(map[string]SlackConfig)
+	loaded := make(map[string]SlackConfig)
 
 	// Decode the json into something we can process.  The JSON is set up to load
 	// into a map.  We could also do an array and move it to a map, but why?
 	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&slackers)
+	err = decoder.Decode(&loaded)
 	if err != nil {
 		log.Printf("error: Could not decode Slackers JSON/%s", err.Error())
 		return false
 	}
+	slackerLock.Lock()
+	defer slackerLock.Unlock()
+	slackers = loaded
 	log.Printf("info: Loaded %d Slackers from disk.", len(slackers))
 
 	// Run through the slackers and see if there are any things we need to set like
@@ -149,6 +252,8 @@ func MakeSystemSlacker(params martini.Params) (int, string) {
 	if !ValidateSlacker(params["key_id"]) {
 		return http.StatusBadRequest, "Slacker does not exist."
 	}
+	slackerLock.Lock()
+	defer slackerLock.Unlock()
 	// Set the system.
 	tmp := slackers[params["key_id"]]
 	tmp.IsSystem = true
@@ -157,9 +262,8 @@ func MakeSystemSlacker(params martini.Params) (int, string) {
 	// There can be only one.
 	for key, value := range slackers {
 		if key != params["key_id"] && value.IsSystem {
-			tmp := slackers[params["key_id"]]
-			tmp.IsSystem = false
-			slackers[params["key_id"]] = tmp
+			value.IsSystem = false
+			slackers[key] = value
 		}
 	} // for
 	return http.StatusOK, "System key assigned."
@@ -176,15 +280,45 @@ func UpdateSlacker(sc SlackConfig) (int, string) {
 	if sc.Hook == "" {
 		return http.StatusBadRequest, "You need a Slack hook to receive the messages."
 	}
-	// Everything looks good, update the item to the slacker map.
+	if msg := validateSlackerConfig(sc); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	// Everything looks good, update the item to the slacker map.  A slacker stays on or
+	// off unless the caller says otherwise.
+	slackerLock.Lock()
+	defer slackerLock.Unlock()
+	if sc.Active == nil {
+		sc.Active = slackers[sc.Key].Active
+	}
 	slackers[sc.Key] = sc
 	return http.StatusOK, "Config record updated."
 } // func
 
 // ValidateSlacker will make sure the slacker record actually exists.
 func ValidateSlacker(id string) bool {
+	slackerLock.RLock()
+	defer slackerLock.RUnlock()
 	if slackers[id].Key == "" {
 		return false
 	}
 	return true
 } // func
+
+// validateSlackerConfig returns what is wrong with the slacker's settings, if anything.
+func validateSlackerConfig(sc SlackConfig) string {
+	if msg := sc.QuietHours.Validate(); msg != "" {
+		return msg
+	}
+	if sc.MessageTemplateId != "" && !ValidTemplateId(sc.MessageTemplateId) {
+		return "Message template does not exist."
+	}
+	if !ValidOversizeMode(sc.OversizeMode) {
+		return "oversize_mode must be split or truncate."
+	}
+	for action, color := range sc.Colors {
+		if !ValidColor(color) {
+			return "The " + action + " color must be good, warning, danger or #RRGGBB."
+		}
+	} // for
+	return ValidateActions(sc.Actions)
+} // func
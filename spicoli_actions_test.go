@@ -0,0 +1,72 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = Describe("Actions", func() {
+
+	Context("Validate Actions", func() {
+		DescribeTable("accepts a good catalog",
+			func(actions map[string]ActionDef) {
+				Expect(ValidateActions(actions)).To(BeEmpty())
+			},
+			Entry("none", map[string]ActionDef(nil)),
+			Entry("full", map[string]ActionDef{"deploy": {IconEmoji: ":rocket:", Color: "#439FE0", Priority: "urgent", Prefix: "*Deploy*"}}),
+			Entry("longest prefix", map[string]ActionDef{"deploy": {Prefix: strings.Repeat("x", MAX_PREFIX_LENGTH)}}),
+		)
+
+		DescribeTable("rejects a bad catalog",
+			func(actions map[string]ActionDef) {
+				Expect(ValidateActions(actions)).ToNot(BeEmpty())
+			},
+			Entry("bad name", map[string]ActionDef{"de ploy": {}}),
+			Entry("bad color", map[string]ActionDef{"deploy": {Color: "blue"}}),
+			Entry("bad priority", map[string]ActionDef{"deploy": {Priority: "asap"}}),
+			Entry("prefix too long", map[string]ActionDef{"deploy": {Prefix: strings.Repeat("x", MAX_PREFIX_LENGTH+1)}}),
+		)
+	}) // Context
+
+	// The slacker sits over config.json, which sits over the defaults.
+	Context("Lookup Action", func() {
+		var (
+			scfg SlackConfig
+		)
+
+		BeforeEach(func() {
+			appConfig.Actions = map[string]ActionDef{"error": {Color: "#FF0000"}, "deploy": {IconEmoji: ":rocket:"}}
+			scfg = SlackConfig{
+				Actions: map[string]ActionDef{"deploy": {Prefix: "*Deploy*"}},
+				Colors:  map[string]string{"deploy": "good"},
+			}
+		}) // BeforeEach
+
+		AfterEach(func() {
+			appConfig.Actions = nil
+		}) // AfterEach
+
+		It("lays config.json over the defaults", func() {
+			def := LookupAction("error", scfg)
+			Expect(def.Color).To(Equal("#FF0000"))
+			Expect(def.IconURL).To(Equal(DEFAULT_ACTIONS["error"].IconURL))
+			Expect(def.Priority).To(Equal("urgent"))
+		}) // It
+
+		It("lays the slacker over config.json", func() {
+			def := LookupAction("deploy", scfg)
+			Expect(def.IconEmoji).To(Equal(":rocket:"))
+			Expect(def.Prefix).To(Equal("*Deploy*"))
+			Expect(def.Color).To(Equal("good"))
+		}) // It
+
+		It("knows the actions from every layer", func() {
+			Expect(KnownAction("deploy", scfg)).To(BeTrue())
+			Expect(KnownAction("", scfg)).To(BeTrue())
+			Expect(KnownAction("rollback", scfg)).To(BeFalse())
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = Describe("Blocks", func() {
+
+	long := func(n int) string { return strings.Repeat("x", n) }
+
+	// Parse the blocks the way they arrive on a message.
+	parse := func(text string) []json.RawMessage {
+		var blocks []json.RawMessage
+		Expect(json.Unmarshal([]byte(text), &blocks)).To(Succeed())
+		return blocks
+	}
+
+	Context("Validate Blocks", func() {
+		DescribeTable("accepts blocks Slack will take",
+			func(blocks string) {
+				Expect(ValidateBlocks(parse(blocks))).To(BeEmpty())
+			},
+			Entry("none", `[]`),
+			Entry("divider", `[{"type":"divider"}]`),
+			Entry("section", `[{"type":"section","text":{"type":"mrkdwn","text":"*hi*"}}]`),
+			Entry("section fields", `[{"type":"section","fields":[{"type":"plain_text","text":"a"},{"type":"mrkdwn","text":"b"}]}]`),
+			Entry("section button", `[{"type":"section","text":{"type":"plain_text","text":"hi"},"accessory":{"type":"button","text":{"type":"plain_text","text":"Go"},"url":"https://example.com","style":"primary"}}]`),
+			Entry("header", `[{"type":"header","text":{"type":"plain_text","text":"Release"}}]`),
+			Entry("image", `[{"type":"image","image_url":"https://example.com/a.png","alt_text":"a"}]`),
+			Entry("context", `[{"type":"context","elements":[{"type":"image","image_url":"https://example.com/a.png","alt_text":"a"},{"type":"mrkdwn","text":"b"}]}]`),
+			Entry("actions", `[{"type":"actions","elements":[{"type":"static_select","options":[{"text":{"type":"plain_text","text":"a"},"value":"a"}]},{"type":"datepicker"}]}]`),
+			Entry("rich text", `[{"type":"rich_text","elements":[{"type":"rich_text_section","elements":[]}]}]`),
+			Entry("video", `[{"type":"video","video_url":"https://example.com/v","thumbnail_url":"https://example.com/t.png","alt_text":"v","title":{"type":"plain_text","text":"Demo"}}]`),
+		)
+
+		DescribeTable("rejects blocks Slack won't take",
+			func(blocks string, problem string) {
+				Expect(ValidateBlocks(parse(blocks))).To(Equal(problem))
+			},
+			Entry("too many blocks", `[`+strings.Repeat(`{"type":"divider"},`, MAX_BLOCKS)+`{"type":"divider"}]`, "No more than 50 blocks are allowed."),
+			Entry("not an object", `["divider"]`, "blocks[0] must be an object."),
+			Entry("null", `[null]`, "blocks[0] must be an object."),
+			Entry("missing type", `[{"text":"hi"}]`, "blocks[0].type is missing."),
+			Entry("unknown type", `[{"type":"modal"}]`, "blocks[0].type modal is not a block that can be sent in a message."),
+			Entry("duplicate block id", `[{"type":"divider","block_id":"a"},{"type":"divider","block_id":"a"}]`, "blocks[1].block_id a is used more than once."),
+			Entry("block id too long", `[{"type":"divider","block_id":"`+long(MAX_BLOCK_ID+1)+`"}]`, "blocks[0].block_id is longer than 255 characters."),
+			Entry("empty section", `[{"type":"section"}]`, "blocks[0] needs text or fields."),
+			Entry("section text too long", `[{"type":"section","text":{"type":"mrkdwn","text":"`+long(MAX_SECTION_TEXT+1)+`"}}]`, "blocks[0].text.text is longer than 3000 characters."),
+			Entry("section text type", `[{"type":"section","text":{"type":"html","text":"hi"}}]`, "blocks[0].text.type must be plain_text or mrkdwn."),
+			Entry("too many fields", `[{"type":"section","fields":[`+strings.Repeat(`{"type":"plain_text","text":"a"},`, MAX_SECTION_FIELDS)+`{"type":"plain_text","text":"a"}]}]`, "blocks[0].fields can have no more than 10 items."),
+			Entry("header in mrkdwn", `[{"type":"header","text":{"type":"mrkdwn","text":"hi"}}]`, "blocks[0].text.type must be plain_text."),
+			Entry("empty header", `[{"type":"header","text":{"type":"plain_text","text":" "}}]`, "blocks[0].text.text can't be empty."),
+			Entry("image without alt text", `[{"type":"image","image_url":"https://example.com/a.png"}]`, "blocks[0].alt_text is missing."),
+			Entry("image url not a string", `[{"type":"image","image_url":5,"alt_text":"a"}]`, "blocks[0].image_url must be a string."),
+			Entry("empty context", `[{"type":"context","elements":[]}]`, "blocks[0].elements must be a list with at least one item."),
+			Entry("button style", `[{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Go"},"style":"loud"}]}]`, "blocks[0].elements[0].style must be primary or danger."),
+			Entry("button text too long", `[{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"`+long(MAX_BUTTON_TEXT+1)+`"}}]}]`, "blocks[0].elements[0].text.text is longer than 75 characters."),
+			Entry("unknown element", `[{"type":"actions","elements":[{"type":"input"}]}]`, "blocks[0].elements[0].type input is not an element that can be used here."),
+			Entry("too many overflow options", `[{"type":"actions","elements":[{"type":"overflow","options":[`+strings.Repeat(`{"text":{"type":"plain_text","text":"a"},"value":"a"},`, MAX_OVERFLOW_OPTIONS)+`{"text":{"type":"plain_text","text":"a"},"value":"a"}]}]}]`, "blocks[0].elements[0].options can have no more than 5 items."),
+			Entry("option without value", `[{"type":"actions","elements":[{"type":"checkboxes","options":[{"text":{"type":"mrkdwn","text":"a"}}]}]}]`, "blocks[0].elements[0].options[0].value is missing."),
+			Entry("video without title", `[{"type":"video","video_url":"https://example.com/v","thumbnail_url":"https://example.com/t.png","alt_text":"v"}]`, "blocks[0].title is missing."),
+		)
+	}) // Context
+
+	// The first section's text stands in for the message text.
+	Context("Blocks Text", func() {
+		It("uses the first section", func() {
+			blocks := parse(`[{"type":"divider"},{"type":"section","text":{"type":"mrkdwn","text":"first"}},{"type":"section","text":{"type":"mrkdwn","text":"second"}}]`)
+			Expect(BlocksText(blocks)).To(Equal("first"))
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,127 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Breaker", func() {
+
+	// Fail the same post on a hook until the breaker would trip.
+	failHook := func(name string, attempt DeliveryAttempt) SlackMessageOut {
+		doc := SlackMessageOut{Id: "id", Hook: "https://hooks.example.com/" + name, IsNotification: true}
+		doc.Attempts = []DeliveryAttempt{attempt}
+		for i := 0; i < DEFAULT_BREAKER_THRESHOLD; i++ {
+			RecordDelivery(doc, false)
+		} // for
+		return doc
+	}
+
+	// Only trouble with the hook itself counts, not a message Slack turned down.
+	DescribeTable("counts hook trouble",
+		func(name string, attempt DeliveryAttempt, open bool) {
+			doc := failHook(name, attempt)
+			allowed, _ := AllowDelivery(doc.Hook)
+			Expect(allowed).To(Equal(!open))
+		},
+		Entry("connection error", "connection error", DeliveryAttempt{Error: "connection refused"}, true),
+		Entry("server error", "server error", DeliveryAttempt{StatusCode: 503, Response: "service unavailable"}, true),
+		Entry("throttled", "throttled", DeliveryAttempt{StatusCode: 429, Response: "rate_limited"}, true),
+		Entry("hook gone", "hook gone", DeliveryAttempt{StatusCode: 404, Response: "no_service"}, true),
+		Entry("invalid payload", "invalid payload", DeliveryAttempt{StatusCode: 400, Response: "invalid_payload"}, false),
+		Entry("invalid blocks", "invalid blocks", DeliveryAttempt{StatusCode: 400, Response: "invalid_blocks"}, false),
+		Entry("invalid attachments", "invalid attachments", DeliveryAttempt{StatusCode: 400, Response: "invalid_attachments"}, false),
+	)
+
+	// An open breaker holds messages back for the rest of its cooldown, but a hook
+	// that is gone for good has nothing to wait for.
+	It("says how long to wait", func() {
+		doc := failHook("waiting", DeliveryAttempt{StatusCode: 503})
+		allowed, wait := AllowDelivery(doc.Hook)
+		Expect(allowed).To(BeFalse())
+		Expect(wait).To(BeNumerically("~", BreakerCooldown(), time.Second))
+
+		doc = failHook("gone", DeliveryAttempt{StatusCode: 404, Response: "no_service"})
+		allowed, wait = AllowDelivery(doc.Hook)
+		Expect(allowed).To(BeFalse())
+		Expect(wait).To(BeZero())
+	}) // It
+
+	It("closes the breaker when Slack turns a message down", func() {
+		doc := SlackMessageOut{Id: "id", Hook: "https://hooks.example.com/flaky", IsNotification: true}
+		doc.Attempts = []DeliveryAttempt{{StatusCode: 500}}
+		for i := 0; i < DEFAULT_BREAKER_THRESHOLD-1; i++ {
+			RecordDelivery(doc, false)
+		} // for
+		doc.Attempts = []DeliveryAttempt{{StatusCode: 400, Response: "invalid_blocks"}}
+		RecordDelivery(doc, false)
+		doc.Attempts = []DeliveryAttempt{{StatusCode: 500}}
+		RecordDelivery(doc, false)
+		allowed, _ := AllowDelivery(doc.Hook)
+		Expect(allowed).To(BeTrue(), "A message Slack turned down counted against the hook.")
+	}) // It
+
+	// A channel that is archived or gone takes out only the slackers posting to it.
+	Context("Channel Gone", func() {
+		var (
+			saved map[string]SlackConfig
+		)
+
+		hook := "https://hooks.example.com/channel-gone"
+
+		BeforeEach(func() {
+			slackerLock.Lock()
+			saved = slackers
+			slackers = map[string]SlackConfig{
+				"ops":   {Key: "ops", Hook: hook, SlackData: SlackMessage{Channel: "#Ops"}},
+				"build": {Key: "build", Hook: hook, SlackData: SlackMessage{Channel: "#builds"}},
+			}
+			slackerLock.Unlock()
+		}) // BeforeEach
+
+		AfterEach(func() {
+			slackerLock.Lock()
+			slackers = saved
+			slackerLock.Unlock()
+		}) // AfterEach
+
+		DescribeTable("reads Slack's answer before the status",
+			func(attempt DeliveryAttempt, reason string) {
+				permanent, why := IsPermanentFailure(attempt)
+				Expect(permanent).To(BeTrue())
+				Expect(why).To(Equal(reason))
+			},
+			Entry("channel not found", DeliveryAttempt{StatusCode: 404, Response: "channel_not_found"}, "channel_not_found"),
+			Entry("channel archived", DeliveryAttempt{StatusCode: 410, Response: "channel_is_archived"}, "channel_is_archived"),
+			Entry("hook gone", DeliveryAttempt{StatusCode: 404, Response: "no_service"}, "no_service"),
+			Entry("no answer", DeliveryAttempt{StatusCode: 410}, "410 "),
+		)
+
+		It("keeps the hook and the other slackers going", func() {
+			doc := SlackMessageOut{Id: "id", Hook: hook, IsNotification: true}
+			doc.Payload.Channel = "ops"
+			doc.Attempts = []DeliveryAttempt{{StatusCode: 404, Response: "channel_not_found"}}
+			RecordDelivery(doc, false)
+
+			allowed, _ := AllowDelivery(hook)
+			Expect(allowed).To(BeTrue(), "The breaker opened for a missing channel.")
+			Expect(GetSlacker("ops").IsActive()).To(BeFalse())
+			Expect(GetSlacker("build").IsActive()).To(BeTrue())
+		}) // It
+
+		It("leaves slackers alone when a message picked another channel", func() {
+			doc := SlackMessageOut{Id: "id", Hook: hook, IsNotification: true}
+			doc.Payload.Channel = "#deploys"
+			doc.Attempts = []DeliveryAttempt{{StatusCode: 404, Response: "channel_not_found"}}
+			RecordDelivery(doc, false)
+
+			allowed, _ := AllowDelivery(hook)
+			Expect(allowed).To(BeTrue())
+			Expect(GetSlacker("ops").IsActive()).To(BeTrue())
+			Expect(GetSlacker("build").IsActive()).To(BeTrue())
+		}) // It
+	}) // Context
+
+}) // Describe
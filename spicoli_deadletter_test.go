@@ -0,0 +1,58 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Dead Letters", func() {
+
+	var (
+		dir          string
+		savedFile    string
+		savedLog     string
+		savedLetters map[string]DeadLetter
+	)
+
+	// Keep the dead letters in a scratch directory.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "deadletters")
+		savedFile, savedLog, savedLetters = deadLetterFile, deadLetterLog, deadLetters
+		deadLetterFile = filepath.Join(dir, "deadletters.json")
+		deadLetterLog = filepath.Join(dir, "deadletters.log")
+		deadLetters = nil
+	}) // BeforeEach
+
+	AfterEach(func() {
+		deadLetterFile, deadLetterLog, deadLetters = savedFile, savedLog, savedLetters
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	// A crash before the next flush loses nothing.
+	It("keeps letters added since the last flush", func() {
+		first := AddDeadLetter("Channel is not allowed", "key", &SlackMessageIn{Id: "one"}, nil)
+		FlushDeadLetters()
+		info, err := os.Stat(deadLetterLog)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(BeZero(), "The log should start over after the flush.")
+		second := AddDeadLetter("Channel is not allowed", "key", &SlackMessageIn{Id: "two"}, nil)
+
+		deadLetters = nil
+		Expect(LoadDeadLetters()).To(BeTrue())
+		Expect(deadLetters).To(HaveKey(first))
+		Expect(deadLetters).To(HaveKey(second))
+	}) // It
+
+	It("keeps only the latest letters for unknown keys", func() {
+		kept := AddDeadLetter("Channel is not allowed", "key", &SlackMessageIn{Id: "kept"}, nil)
+		for i := 0; i < MAX_UNKNOWN_KEY_LETTERS+10; i++ {
+			AddUnknownKeyLetter(SlackMessageIn{Id: "stray", Key: "made-up"})
+		} // for
+		Expect(SelectDeadLetters("made-up")).To(HaveLen(MAX_UNKNOWN_KEY_LETTERS))
+		Expect(deadLetters).To(HaveKey(kept), "A dead letter for a real slacker was thrown away.")
+	}) // It
+
+}) // Describe
@@ -0,0 +1,101 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Directory", func() {
+
+	var (
+		dir            string
+		savedFile      string
+		savedDirectory map[string]DirectoryEntry
+	)
+
+	// Keep the directory in a scratch directory.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "directory")
+		directoryLock.Lock()
+		savedFile, savedDirectory = directoryFile, directory
+		directoryFile = filepath.Join(dir, "directory.json")
+		directory = nil
+		directoryLock.Unlock()
+	}) // BeforeEach
+
+	AfterEach(func() {
+		directoryLock.Lock()
+		directoryFile, directory = savedFile, savedDirectory
+		directoryLock.Unlock()
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	// The main loop saves and then reloads the directory.  An entry added in between
+	// has to survive the reload.
+	Context("Reload", func() {
+		It("keeps an entry added since the last save", func() {
+			FlushDirectory()
+			rsp := httptest.NewRecorder()
+			code, _ := PutDirectoryEntry(DirectoryEntry{SlackId: "U024BE7LH"}, map[string]string{"name": "jeff"}, rsp)
+			Expect(code).To(Equal(http.StatusOK))
+
+			Expect(LoadDirectory()).To(BeTrue())
+			Expect(directory).To(HaveKey("jeff"))
+		}) // It
+
+		It("doesn't bring back an entry deleted since the last save", func() {
+			PutDirectoryEntry(DirectoryEntry{SlackId: "U024BE7LH"}, map[string]string{"name": "jeff"}, httptest.NewRecorder())
+			FlushDirectory()
+			code, _ := DeleteDirectoryEntry(map[string]string{"name": "jeff"})
+			Expect(code).To(Equal(http.StatusOK))
+
+			Expect(LoadDirectory()).To(BeTrue())
+			Expect(directory).To(BeEmpty())
+		}) // It
+	}) // Context
+
+	Context("Resolve Mentions", func() {
+		BeforeEach(func() {
+			directory = map[string]DirectoryEntry{
+				"jeff":                       {Name: "jeff", SlackId: "U024BE7LH"},
+				"jdoe@centricconsulting.com": {Name: "jdoe@centricconsulting.com", SlackId: "W012A3CDE"},
+				"oncall":                     {Name: "oncall", SlackId: "S0614TZR7"},
+			}
+		}) // BeforeEach
+
+		DescribeTable("turns names in the directory into mentions",
+			func(text string, resolved string) {
+				Expect(ResolveMentions(SlackMessageIn{Text: text}).Text).To(Equal(resolved))
+			},
+			Entry("handle", "ping @jeff now", "ping <@U024BE7LH> now"),
+			Entry("any case", "ping @Jeff", "ping <@U024BE7LH>"),
+			Entry("email", "ask @jdoe@centricconsulting.com", "ask <@W012A3CDE>"),
+			Entry("user group", "@oncall please look", "<!subteam^S0614TZR7> please look"),
+			Entry("full stop", "thanks @jeff.", "thanks <@U024BE7LH>."),
+			Entry("ellipsis", "waiting on @jeff...", "waiting on <@U024BE7LH>..."),
+			Entry("comma", "@jeff, @oncall", "<@U024BE7LH>, <!subteam^S0614TZR7>"),
+			Entry("email then full stop", "mail @jdoe@centricconsulting.com.", "mail <@W012A3CDE>."),
+			Entry("in brackets", "(@jeff)", "(<@U024BE7LH>)"),
+			Entry("unknown name", "ping @nobody", "ping @nobody"),
+			Entry("inside a word", "me@jeff", "me@jeff"),
+			Entry("inside code", "run `@jeff` as @jeff", "run `@jeff` as <@U024BE7LH>"),
+		)
+
+		It("leaves plain text as it was written", func() {
+			doc := ResolveMentions(SlackMessageIn{Format: FORMAT_PLAIN, Text: "ping @jeff"})
+			Expect(doc.Text).To(Equal("ping @jeff"))
+		}) // It
+
+		It("resolves markdown once it has been formatted", func() {
+			doc := ResolveMentions(FormatMessage(SlackMessageIn{Format: FORMAT_MARKDOWN, Text: "**ping** @jeff"}))
+			Expect(doc.Text).To(Equal("*ping* <@U024BE7LH>"))
+		}) // It
+	}) // Context
+
+}) // Describe
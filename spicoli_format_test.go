@@ -0,0 +1,95 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Format", func() {
+
+	// Escaping mrkdwn leaves Slack's own markup alone and is safe to do twice.
+	Context("Escape Mrkdwn", func() {
+		DescribeTable("escapes the text once",
+			func(text string, escaped string) {
+				Expect(EscapeMrkdwn(text)).To(Equal(escaped))
+				Expect(EscapeMrkdwn(EscapeMrkdwn(text))).To(Equal(escaped), "Escaping twice should change nothing.")
+			},
+			Entry("plain text", "plain text", "plain text"),
+			Entry("ampersand", "a & b", "a &amp; b"),
+			Entry("angle brackets", "1 < 2 > 0", "1 &lt; 2 &gt; 0"),
+			Entry("entities already escaped", "already &amp; &lt;escaped&gt;", "already &amp; &lt;escaped&gt;"),
+			Entry("other entities", "&nbsp;", "&amp;nbsp;"),
+			Entry("link", "see <https://example.com|the docs>", "see <https://example.com|the docs>"),
+			Entry("mailto", "mail <mailto:ops@example.com>", "mail <mailto:ops@example.com>"),
+			Entry("mentions", "hey <@U123ABC> and <!here> in <#C0123|ops>", "hey <@U123ABC> and <!here> in <#C0123|ops>"),
+			Entry("tag", "<script>", "&lt;script&gt;"),
+			Entry("other scheme", "<ftp://example.com>", "&lt;ftp://example.com&gt;"),
+			Entry("unclosed bracket", "a <b", "a &lt;b"),
+		)
+	}) // Context
+
+	// Plain text escapes everything, including what would be a mention.
+	Context("Escape Plain", func() {
+		It("escapes mentions and links", func() {
+			Expect(EscapePlain("<@U123> & <https://example.com>")).To(Equal("&lt;@U123&gt; &amp; &lt;https://example.com&gt;"))
+		}) // It
+	}) // Context
+
+	Context("Markdown To Mrkdwn", func() {
+		DescribeTable("converts the markup",
+			func(text string, mrkdwn string) {
+				Expect(MarkdownToMrkdwn(text)).To(Equal(mrkdwn))
+			},
+			Entry("bold", "**done**", "*done*"),
+			Entry("underscore bold", "__done__", "*done*"),
+			Entry("italic", "*maybe*", "_maybe_"),
+			Entry("bold and italic", "**a** and *b*", "*a* and _b_"),
+			Entry("strike", "~~gone~~", "~gone~"),
+			Entry("lone asterisks", "2 * 3 * 4", "2 * 3 * 4"),
+			Entry("link", "[the docs](https://example.com)", "<https://example.com|the docs>"),
+			Entry("link with title", `[docs](https://example.com "Docs")`, "<https://example.com|docs>"),
+			Entry("image", "![build](https://example.com/b.png)", "<https://example.com/b.png|build>"),
+			Entry("image without alt", "![](https://example.com/b.png)", "<https://example.com/b.png>"),
+			Entry("autolink", "<https://example.com>", "<https://example.com>"),
+			Entry("mentions", "hey <@U123ABC> and <!here>, **look**", "hey <@U123ABC> and <!here>, *look*"),
+			Entry("channel and user group", "<#C0123|ops> <!subteam^S0123>", "<#C0123|ops> <!subteam^S0123>"),
+			Entry("slack link", "<https://example.com/a_b_|**docs**>", "<https://example.com/a_b_|**docs**>"),
+			Entry("mention in inline code", "`<@U123>`", "`&lt;@U123&gt;`"),
+			Entry("tag", "<b>x</b>", "&lt;b&gt;x&lt;/b&gt;"),
+			Entry("escapes", "a < b & c", "a &lt; b &amp; c"),
+			Entry("heading", "## Release **1.2**", "*Release 1.2*"),
+			Entry("heading with italic", "### Release *1.2*", "*Release _1.2_*"),
+			Entry("closed heading", "# Title #", "*Title*"),
+			Entry("bullets", "- one\n  * two\n+ three", "• one\n  • two\n• three"),
+			Entry("rule", "---", "──────────"),
+			Entry("inline code", "run `**x** < y` now", "run `**x** &lt; y` now"),
+			Entry("code block", "```go\nif a < b && **c** {\n```\n**after**", "```\nif a &lt; b &amp;&amp; **c** {\n```\n*after*"),
+			Entry("tilde fence", "~~~\n# not a heading\n~~~", "```\n# not a heading\n```"),
+			Entry("unclosed backtick", "a ` **b**", "a ` *b*"),
+		)
+	}) // Context
+
+	// Markdown goes out as mrkdwn, everything else keeps the format it came in with.
+	Context("Format Message", func() {
+		DescribeTable("formats the text",
+			func(format string, text string, formatted string, sent string) {
+				doc := FormatMessage(SlackMessageIn{Format: format, Text: text})
+				Expect(doc.Text).To(Equal(formatted))
+				Expect(doc.Format).To(Equal(sent))
+			},
+			Entry("no format", "", "**a** <@U1>", "**a** <@U1>", ""),
+			Entry("mrkdwn", FORMAT_MRKDWN, "a & b", "a &amp; b", FORMAT_MRKDWN),
+			Entry("plain", FORMAT_PLAIN, "<@U1>", "&lt;@U1&gt;", FORMAT_PLAIN),
+			Entry("markdown", FORMAT_MARKDOWN, "**a**", "*a*", FORMAT_MRKDWN),
+		)
+
+		It("accepts only the known formats", func() {
+			for _, format := range []string{"", "plain", "markdown", "mrkdwn"} {
+				Expect(ValidFormat(format)).To(BeTrue(), format)
+			} // for
+			Expect(ValidFormat("html")).To(BeFalse())
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,184 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Groups", func() {
+
+	var (
+		dir           string
+		savedFile     string
+		savedGroups   map[string]SlackerGroup
+		savedSlackers map[string]SlackConfig
+	)
+
+	// Keep the groups in a scratch directory, with a couple of slackers to put in them.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "groups")
+		groupLock.Lock()
+		savedFile, savedGroups = groupFile, groups
+		groupFile = filepath.Join(dir, "groups.json")
+		groups = nil
+		groupLock.Unlock()
+
+		slackerLock.Lock()
+		savedSlackers = slackers
+		slackers = map[string]SlackConfig{
+			"ops":   {Key: "ops", Name: "Ops", Hook: "https://hooks.example.com/ops"},
+			"build": {Key: "build", Name: "Build", Hook: "https://hooks.example.com/build"},
+		}
+		slackerLock.Unlock()
+	}) // BeforeEach
+
+	AfterEach(func() {
+		groupLock.Lock()
+		groupFile, groups = savedFile, savedGroups
+		groupLock.Unlock()
+		slackerLock.Lock()
+		slackers = savedSlackers
+		slackerLock.Unlock()
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	// The main loop saves and then reloads the groups.  A group added in between has
+	// to survive the reload.
+	Context("Reload", func() {
+		It("keeps a group added since the last save", func() {
+			FlushGroups()
+			rsp := httptest.NewRecorder()
+			code, _ := AddGroup(SlackerGroup{Name: "Everyone", Members: []string{"ops", "build"}}, rsp)
+			Expect(code).To(Equal(http.StatusCreated))
+
+			Expect(LoadGroups()).To(BeTrue())
+			Expect(groups).To(HaveLen(1))
+		}) // It
+
+		It("doesn't bring back a group deleted since the last save", func() {
+			AddGroup(SlackerGroup{Name: "Everyone", Members: []string{"ops", "build"}}, httptest.NewRecorder())
+			FlushGroups()
+			for key := range groups {
+				code, _ := DeleteGroup(map[string]string{"group_id": key})
+				Expect(code).To(Equal(http.StatusOK))
+			} // for
+
+			Expect(LoadGroups()).To(BeTrue())
+			Expect(groups).To(BeEmpty())
+		}) // It
+	}) // Context
+
+	// Each slacker in the group gets a leg of its own, delivered and tracked on its own.
+	Context("Fan Out", func() {
+		var (
+			savedLog        string
+			savedLetterFile string
+			savedLetterLog  string
+			savedLetters    map[string]DeadLetter
+			opsHook         *httptest.Server
+			buildHook       *httptest.Server
+			posted          chan string
+		)
+
+		// The legs go through the suite's own inbound loop and workers, with the queue
+		// log and dead letters kept in the scratch directory.
+		BeforeEach(func() {
+			queueLogLock.Lock()
+			queueLog.Close()
+			queueLog = nil
+			savedLog = queueLogFile
+			queueLogFile = filepath.Join(dir, "queue.log")
+			queueLogLock.Unlock()
+			OpenQueueLog()
+
+			deadLetterLock.Lock()
+			savedLetterFile, savedLetterLog, savedLetters = deadLetterFile, deadLetterLog, deadLetters
+			deadLetterFile = filepath.Join(dir, "deadletters.json")
+			deadLetterLog = filepath.Join(dir, "deadletters.log")
+			deadLetters = nil
+			deadLetterLock.Unlock()
+
+			posted = make(chan string, 10)
+			opsHook = httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+				posted <- "ops"
+			}))
+			buildHook = httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+				posted <- "build"
+			}))
+			slackerLock.Lock()
+			ops, build := slackers["ops"], slackers["build"]
+			ops.Hook, build.Hook = opsHook.URL, buildHook.URL
+			slackers["ops"], slackers["build"] = ops, build
+			slackerLock.Unlock()
+		}) // BeforeEach
+
+		AfterEach(func() {
+			opsHook.Close()
+			buildHook.Close()
+
+			queueLogLock.Lock()
+			queueLog.Close()
+			queueLog = nil
+			queueLogFile = savedLog
+			queueLogLock.Unlock()
+			OpenQueueLog()
+
+			deadLetterLock.Lock()
+			deadLetterFile, deadLetterLog, deadLetters = savedLetterFile, savedLetterLog, savedLetters
+			deadLetterLock.Unlock()
+		}) // AfterEach
+
+		// The state of each leg of the message, in order.
+		legStates := func(id string) []string {
+			states := []string{}
+			statusLock.Lock()
+			defer statusLock.Unlock()
+			for _, leg := range statuses[id].Legs {
+				states = append(states, statuses[leg].State)
+			} // for
+			return states
+		}
+
+		It("sends each slacker its own leg", func() {
+			code, receipt := FanOut(SlackMessageIn{Id: "fan-all", Text: "release 1.2"}, SlackerGroup{Members: []string{"ops", "build"}}, httptest.NewRecorder())
+			Expect(code).To(Equal(http.StatusAccepted))
+			legs := MessageLegs("fan-all")
+			Expect(legs).To(HaveLen(2))
+			Expect(legs[0]).ToNot(Equal(legs[1]))
+			Expect(receipt).To(ContainSubstring(legs[0]))
+			Expect(receipt).To(ContainSubstring(legs[1]))
+
+			hooks := []string{}
+			for len(hooks) < 2 {
+				select {
+				case hook := <-posted:
+					hooks = append(hooks, hook)
+				case <-time.After(5 * time.Second):
+					Fail("The legs were never posted.")
+				}
+			} // for
+			Expect(hooks).To(ConsistOf("ops", "build"))
+			Eventually(func() []string { return legStates("fan-all") }, 5*time.Second).Should(Equal([]string{STATE_DELIVERED, STATE_DELIVERED}))
+
+			statusLock.Lock()
+			state := statuses["fan-all"].State
+			statusLock.Unlock()
+			Expect(state).To(Equal(STATE_FANNED_OUT))
+		}) // It
+
+		It("tracks a leg that fails apart from the rest", func() {
+			code, _ := FanOut(SlackMessageIn{Id: "fan-some", Text: "release 1.2"}, SlackerGroup{Members: []string{"ops", "gone"}}, httptest.NewRecorder())
+			Expect(code).To(Equal(http.StatusAccepted))
+
+			Eventually(func() []string { return legStates("fan-some") }, 5*time.Second).Should(Equal([]string{STATE_DELIVERED, STATE_DEAD_LETTERED}))
+			Expect(posted).To(HaveLen(1))
+		}) // It
+	}) // Context
+
+}) // Describe
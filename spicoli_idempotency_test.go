@@ -0,0 +1,101 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Idempotency", func() {
+
+	var (
+		dir       string
+		savedFile string
+		savedKeys map[string]IdempotencyRecord
+	)
+
+	// Keep the keys in a scratch directory.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "idempotency")
+		idempotencyLock.Lock()
+		savedFile, savedKeys = idempotencyFile, idempotencyKeys
+		idempotencyFile = filepath.Join(dir, "idempotency.json")
+		idempotencyKeys = nil
+		idempotencyLock.Unlock()
+	}) // BeforeEach
+
+	AfterEach(func() {
+		idempotencyLock.Lock()
+		idempotencyFile, idempotencyKeys = savedFile, savedKeys
+		idempotencyLock.Unlock()
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	Context("Claim", func() {
+		It("returns the first message's Id for a duplicate", func() {
+			id, ok := ClaimIdempotencyKey("slacker", "deploy-42", "first")
+			Expect(ok).To(BeTrue())
+			Expect(id).To(Equal("first"))
+
+			id, ok = ClaimIdempotencyKey("slacker", "deploy-42", "second")
+			Expect(ok).To(BeFalse())
+			Expect(id).To(Equal("first"))
+		}) // It
+
+		It("keeps each slacker's keys apart", func() {
+			ClaimIdempotencyKey("slacker", "deploy-42", "first")
+			id, ok := ClaimIdempotencyKey("other", "deploy-42", "second")
+			Expect(ok).To(BeTrue())
+			Expect(id).To(Equal("second"))
+		}) // It
+
+		It("lets a key be used again once it has expired", func() {
+			idempotencyKeys = map[string]IdempotencyRecord{
+				"slacker|deploy-42": {MessageId: "first", Expires: time.Now().UTC().Add(-time.Second)},
+			}
+			id, ok := ClaimIdempotencyKey("slacker", "deploy-42", "second")
+			Expect(ok).To(BeTrue())
+			Expect(id).To(Equal("second"))
+		}) // It
+
+		It("lets a released key be used again", func() {
+			ClaimIdempotencyKey("slacker", "deploy-42", "first")
+			ReleaseIdempotencyKey("slacker", "deploy-42", "first")
+			_, ok := ClaimIdempotencyKey("slacker", "deploy-42", "second")
+			Expect(ok).To(BeTrue())
+		}) // It
+	}) // Context
+
+	// The keys are saved so a restart doesn't let duplicates through.
+	Context("Load", func() {
+		It("remembers a key across a restart", func() {
+			ClaimIdempotencyKey("slacker", "deploy-42", "first")
+			FlushIdempotencyKeys()
+			idempotencyKeys = nil
+
+			Expect(LoadIdempotencyKeys()).To(BeTrue())
+			id, ok := ClaimIdempotencyKey("slacker", "deploy-42", "second")
+			Expect(ok).To(BeFalse())
+			Expect(id).To(Equal("first"))
+		}) // It
+
+		It("keeps a key claimed since the last save", func() {
+			FlushIdempotencyKeys()
+			ClaimIdempotencyKey("slacker", "deploy-42", "first")
+
+			Expect(LoadIdempotencyKeys()).To(BeTrue())
+			Expect(idempotencyKeys).To(HaveKey("slacker|deploy-42"))
+		}) // It
+
+		It("drops the keys that expired on disk", func() {
+			ioutil.WriteFile(idempotencyFile, []byte(`{"slacker|old":{"message_id":"first","expires":"2001-01-01T00:00:00Z"}}`), 0644)
+
+			Expect(LoadIdempotencyKeys()).To(BeTrue())
+			Expect(idempotencyKeys).To(BeEmpty())
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,137 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Lanes", func() {
+
+	// An explicit priority wins, otherwise the action decides.
+	Context("Message Priority", func() {
+		DescribeTable("picks the lane",
+			func(priority string, action string, lane int) {
+				Expect(MessagePriority(priority, action, "no-such-key")).To(Equal(lane))
+			},
+			Entry("nothing", "", "", PRIORITY_NORMAL),
+			Entry("info", "", "info", PRIORITY_LOW),
+			Entry("warn", "", "warn", PRIORITY_HIGH),
+			Entry("error", "", "error", PRIORITY_URGENT),
+			Entry("raised", "high", "info", PRIORITY_HIGH),
+			Entry("any case", "LOW", "warn", PRIORITY_LOW),
+			Entry("errors can't be lowered", "low", "error", PRIORITY_URGENT),
+			Entry("urgent is reserved for errors", "urgent", "info", PRIORITY_LOW),
+			Entry("unknown", "asap", "", PRIORITY_NORMAL),
+		)
+	}) // Context
+
+	Context("Outbound Lanes", func() {
+		var (
+			ol OutboundLanes
+		)
+
+		BeforeEach(func() {
+			ol = NewOutboundLanes(2)
+		}) // BeforeEach
+
+		// Only a more important post can push out a queued one, and the least
+		// important, oldest post goes first.
+		It("evicts the least important post", func() {
+			for _, doc := range []SlackMessageOut{
+				{Id: "info-1", Action: "info"},
+				{Id: "info-2", Action: "info"},
+				{Id: "normal-1", Action: "success"},
+				{Id: "normal-2", Action: "success"},
+			} {
+				Expect(ol.Put(doc)).To(BeTrue(), doc.Id)
+			} // for
+			Expect(ol.Put(SlackMessageOut{Id: "normal-3", Action: "success"})).To(BeFalse(), "The normal lane took more than its room.")
+
+			for _, evict := range []struct {
+				priority int
+				id       string
+			}{
+				{PRIORITY_LOW, ""},
+				{PRIORITY_NORMAL, "info-1"},
+				{PRIORITY_URGENT, "info-2"},
+				{PRIORITY_NORMAL, ""},
+				{PRIORITY_HIGH, "normal-1"},
+			} {
+				victim, ok := ol.Evict(evict.priority)
+				Expect(ok).To(Equal(evict.id != ""))
+				Expect(victim.Id).To(Equal(evict.id))
+			} // for
+
+			Expect(ol.Force(SlackMessageOut{Id: "normal-3", Action: "success"})).To(BeTrue())
+			Expect(ol.Len()).To(Equal(2))
+			Expect(ol.Take().Id).To(Equal("normal-2"), "The oldest post should be taken first.")
+		}) // It
+
+		// Held posts keep their order and feed in as room frees up, but never
+		// ahead of a more important post.
+		It("feeds held posts in as room frees up", func() {
+			ol = NewOutboundLanes(1)
+			for _, id := range []string{"first", "second", "third"} {
+				ol.Hold(SlackMessageOut{Id: id, Action: "success"})
+			} // for
+			ol.Hold(SlackMessageOut{Id: "error", Action: "error"})
+			Expect(ol.Len()).To(Equal(2))
+			Expect(ol.Held()).To(Equal(2))
+			Expect(ol.Backlogged()).To(BeTrue())
+
+			for _, id := range []string{"error", "first", "second", "third"} {
+				Expect(ol.Take().Id).To(Equal(id))
+				ol.feed()
+			} // for
+			Expect(ol.Len()).To(BeZero())
+			Expect(ol.Held()).To(BeZero())
+		}) // It
+
+		// The wait is worked out from how fast this worker takes posts off, not from
+		// how fast messages are being accepted.
+		It("estimates the wait from the worker's own pace", func() {
+			ol = NewOutboundLanes(2)
+			Expect(ol.RetryAfter()).To(Equal(MAX_RETRY_AFTER), "With nothing taken yet there is no telling.")
+
+			for _, id := range []string{"first", "second", "third", "fourth", "fifth"} {
+				ol.Hold(SlackMessageOut{Id: id, Action: "success"})
+			} // for
+			ol.Take()
+			Expect(ol.drain.count).To(Equal(1))
+
+			ol.drain.rate = 2
+			Expect(ol.RetryAfter()).To(Equal(2))
+		}) // It
+
+		// Spilled posts come back in order as room frees up, and only the worker that
+		// spilled has to wait for them.
+		It("refills spilled posts in order", func() {
+			dir, _ := ioutil.TempDir("", "spill")
+			defer os.RemoveAll(dir)
+			ol = NewOutboundLanes(1)
+			ol.spill.file = filepath.Join(dir, "outbound.spill.0")
+			other := NewOutboundLanes(1)
+			other.spill.file = filepath.Join(dir, "outbound.spill.1")
+
+			Expect(ol.Put(SlackMessageOut{Id: "first", Action: "success"})).To(BeTrue())
+			for _, id := range []string{"second", "third"} {
+				Expect(ol.Spill(SlackMessageOut{Id: id, Action: "success"})).To(Succeed())
+			} // for
+			Expect(ol.Spilled()).To(Equal(2))
+			Expect(other.Spilled()).To(BeZero())
+			Expect(other.Put(SlackMessageOut{Id: "elsewhere", Action: "success"})).To(BeTrue())
+
+			for _, id := range []string{"first", "second", "third"} {
+				Expect(ol.Take().Id).To(Equal(id))
+				ol.Refill()
+			} // for
+			Expect(ol.Spilled()).To(BeZero())
+			Expect(ol.Len()).To(BeZero())
+		}) // It
+	}) // Context
+
+}) // Describe
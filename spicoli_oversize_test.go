@@ -0,0 +1,87 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"strings"
+	"unicode/utf8"
+)
+
+var _ = Describe("Oversize", func() {
+
+	longLine := strings.Repeat("word ", 60) // 300 characters
+	longCode := CODE_FENCE + "\n" + strings.Repeat("fmt.Println(42)\n", 20) + CODE_FENCE
+
+	// Every piece has to fit and no piece may leave a code block open.
+	Context("Split Text", func() {
+		DescribeTable("splits into pieces that fit",
+			func(text string, limit int, count int) {
+				pieces := SplitText(text, limit)
+				Expect(pieces).To(HaveLen(count))
+				if limit < MIN_PART_LENGTH {
+					limit = MIN_PART_LENGTH
+				}
+				for i, piece := range pieces {
+					Expect(utf8.RuneCountInString(piece)).To(BeNumerically("<=", limit), "piece %d", i+1)
+					Expect(strings.Count(piece, CODE_FENCE)%2).To(BeZero(), "Piece %d leaves a code block open.", i+1)
+				} // for
+			},
+			Entry("fits", "hello world", 100, 1),
+			Entry("breaks between lines", strings.Repeat("a line of text\n", 20), 100, 4),
+			Entry("breaks a long line at spaces", longLine, 100, 3),
+			Entry("keeps a code block whole", "before\n"+CODE_FENCE+"\nx := 1\n"+CODE_FENCE+"\nafter", 100, 1),
+			Entry("rewraps a long code block", longCode, 150, 3),
+			Entry("raises a limit that is too small", longLine, 5, 3),
+			Entry("raises a negative limit", longLine, -8, 3),
+		)
+
+		It("doesn't cut an escape in half", func() {
+			text := strings.Repeat("a", MIN_PART_LENGTH-2) + "&amp;" + strings.Repeat("b", 50)
+			pieces := SplitText(text, MIN_PART_LENGTH)
+			Expect(pieces).To(HaveLen(2))
+			Expect(pieces[1]).To(HavePrefix("&amp;"))
+		}) // It
+	}) // Context
+
+	// Parts after the first are numbered and get their own ids.
+	Context("Fit Message", func() {
+		BeforeEach(func() {
+			appConfig.MaxTextLength = 0
+		}) // BeforeEach
+
+		DescribeTable("fits the text and prefix into parts",
+			func(text string, prefix string, count int) {
+				scfg := SlackConfig{Key: "key", Actions: map[string]ActionDef{"deploy": {Prefix: prefix}}}
+				doc := SlackMessageIn{Id: "id", Key: "key", Action: "deploy", Text: text}
+				parts := FitMessage(doc, scfg)
+				Expect(parts).To(HaveLen(count))
+				if count > 1 {
+					Expect(parts[0].Text).To(HavePrefix("(1/"))
+					Expect(parts[0].Id).To(Equal("id"))
+					Expect(parts[1].Id).To(Equal("id-2"))
+				}
+			},
+			Entry("short text", "hello world", "", 1),
+			Entry("long text is split", strings.Repeat("a line of text\n", 600), "", 3),
+			Entry("prefix longer than the limit", "hello world", strings.Repeat("x", 3995), 1),
+			Entry("prefix and long text", strings.Repeat("a line of text\n", 300), strings.Repeat("x", 3995), 50),
+		)
+	}) // Context
+
+	Context("Valid Max Text Length", func() {
+		DescribeTable("checks the configured length",
+			func(length int, valid bool) {
+				Expect(ValidMaxTextLength(length)).To(Equal(valid))
+			},
+			Entry("unset", 0, true),
+			Entry("Slack's limit", 4000, true),
+			Entry("shortest", 500, true),
+			Entry("too short", 499, false),
+			Entry("far too short", 13, false),
+			Entry("negative", -1, false),
+			Entry("too long", 40001, false),
+		)
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,83 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Quiet Hours", func() {
+
+	// A night window runs past midnight, so its end is before its start.
+	Context("Overnight window", func() {
+		qh := QuietHours{Windows: []QuietWindow{{Start: "22:00", End: "07:00"}}}
+
+		DescribeTable("is quiet from the start up to the end",
+			func(hour int, minute int, quiet bool) {
+				t := time.Date(2026, time.January, 15, hour, minute, 0, 0, time.UTC)
+				Expect(qh.IsQuiet(t)).To(Equal(quiet))
+			},
+			Entry("evening", 21, 59, false),
+			Entry("start", 22, 0, true),
+			Entry("before midnight", 23, 59, true),
+			Entry("midnight", 0, 0, true),
+			Entry("early morning", 6, 59, true),
+			Entry("end", 7, 0, false),
+			Entry("midday", 12, 0, false),
+		)
+	}) // Context
+
+	Context("Day window", func() {
+		It("is quiet only between the start and the end", func() {
+			qh := QuietHours{Windows: []QuietWindow{{Start: "12:00", End: "13:00"}}}
+			Expect(qh.IsQuiet(time.Date(2026, time.January, 15, 12, 30, 0, 0, time.UTC))).To(BeTrue())
+			Expect(qh.IsQuiet(time.Date(2026, time.January, 15, 13, 0, 0, 0, time.UTC))).To(BeFalse())
+			Expect(qh.IsQuiet(time.Date(2026, time.January, 15, 23, 0, 0, 0, time.UTC))).To(BeFalse())
+		}) // It
+
+		It("is never quiet without windows", func() {
+			Expect(QuietHours{}.IsQuiet(time.Now())).To(BeFalse())
+		}) // It
+	}) // Context
+
+	// The windows are clock times in the slacker's time zone, whatever zone the time
+	// is given in.
+	Context("Time zone", func() {
+		var qh QuietHours
+
+		BeforeEach(func() {
+			if _, err := time.LoadLocation("America/New_York"); err != nil {
+				Skip("no time zone data")
+			}
+			qh = QuietHours{
+				Windows:  []QuietWindow{{Start: "22:00", End: "07:00"}},
+				TimeZone: "America/New_York",
+			}
+		}) // BeforeEach
+
+		DescribeTable("uses the slacker's clock",
+			func(hour int, quiet bool) {
+				t := time.Date(2026, time.January, 15, hour, 0, 0, 0, time.UTC)
+				Expect(qh.IsQuiet(t)).To(Equal(quiet))
+			},
+			Entry("02:00 UTC is 21:00 in New York", 2, false),
+			Entry("03:00 UTC is 22:00 in New York", 3, true),
+			Entry("11:00 UTC is 06:00 in New York", 11, true),
+			Entry("12:00 UTC is 07:00 in New York", 12, false),
+		)
+
+		It("follows daylight saving time", func() {
+			// 02:00 UTC in July is 22:00 in New York.
+			Expect(qh.IsQuiet(time.Date(2026, time.July, 15, 2, 0, 0, 0, time.UTC))).To(BeTrue())
+			Expect(qh.IsQuiet(time.Date(2026, time.July, 15, 11, 0, 0, 0, time.UTC))).To(BeFalse())
+		}) // It
+
+		It("is never quiet with a time zone it doesn't know", func() {
+			qh.TimeZone = "Nowhere/Special"
+			Expect(qh.IsQuiet(time.Date(2026, time.January, 15, 3, 0, 0, 0, time.UTC))).To(BeFalse())
+			Expect(qh.Validate()).To(HavePrefix("Unknown quiet hours time zone"))
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,55 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Rate Limit", func() {
+
+	start := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	// Each call says how long that post has to wait for its turn.
+	Context("Token Bucket", func() {
+		DescribeTable("reserves a token",
+			func(rate float64, burst int, calls []time.Time, waits []time.Duration) {
+				bucket := NewTokenBucket(rate, burst)
+				for i, now := range calls {
+					Expect(bucket.Reserve(now)).To(Equal(waits[i]), "call %d", i+1)
+				} // for
+			},
+			Entry("first is free", 1.0, 1, []time.Time{at(0)}, []time.Duration{0}),
+			Entry("back to back waits its turn", 1.0, 1, []time.Time{at(0), at(0), at(0)}, []time.Duration{0, time.Second, 2 * time.Second}),
+			Entry("refills over time", 1.0, 1, []time.Time{at(0), at(1000), at(1500)}, []time.Duration{0, 0, 500 * time.Millisecond}),
+			Entry("burst goes out together", 1.0, 3, []time.Time{at(0), at(0), at(0), at(0)}, []time.Duration{0, 0, 0, time.Second}),
+			Entry("never holds more than the burst", 1.0, 2, []time.Time{at(0), at(60000), at(60000), at(60000)}, []time.Duration{0, 0, 0, time.Second}),
+			Entry("faster rate", 4.0, 1, []time.Time{at(0), at(0), at(0)}, []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond}),
+			Entry("burst below one is one", 1.0, 0, []time.Time{at(0), at(0)}, []time.Duration{0, time.Second}),
+		)
+	}) // Context
+
+	// A channel limit applies on top of the hook's own limit.
+	Context("Reserve Slot", func() {
+		BeforeEach(func() {
+			appConfig.ChannelRate, appConfig.ChannelBurst = 0.5, 1
+		}) // BeforeEach
+
+		AfterEach(func() {
+			appConfig.ChannelRate, appConfig.ChannelBurst = 0, 0
+		}) // AfterEach
+
+		It("holds back a second post to the same channel", func() {
+			doc := SlackMessageOut{Hook: "https://hooks.example.com/channel-limit"}
+			doc.Payload.Channel = "#ops"
+			Expect(ReserveSlot(doc)).To(BeZero())
+			Expect(ReserveSlot(doc)).To(BeNumerically("~", 2*time.Second, 100*time.Millisecond))
+
+			doc.Payload.Channel = "#dev"
+			Expect(ReserveSlot(doc)).To(BeNumerically("~", 2*time.Second, 100*time.Millisecond), "The hook limit should still apply to another channel.")
+		}) // It
+	}) // Context
+
+}) // Describe
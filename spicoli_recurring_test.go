@@ -0,0 +1,125 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Recurring", func() {
+
+	const clock = "2006-01-02 15:04"
+
+	Context("Parse Cron", func() {
+		DescribeTable("accepts five fields",
+			func(expr string) {
+				_, err := ParseCron(expr)
+				Expect(err).ToNot(HaveOccurred())
+			},
+			Entry("every minute", "* * * * *"),
+			Entry("steps and ranges", "*/15 9-17 * * 1-5"),
+			Entry("lists", "0 0 1,15 * *"),
+			Entry("stepped range", "0-30/10 * * * *"),
+			Entry("Sunday as 7", "0 0 * * 7"),
+			Entry("stepped from a start", "5/20 * * * *"),
+		)
+
+		DescribeTable("rejects anything else",
+			func(expr string) {
+				_, err := ParseCron(expr)
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("too few fields", "* * * *"),
+			Entry("too many fields", "* * * * * *"),
+			Entry("minute out of range", "60 * * * *"),
+			Entry("hour out of range", "* 24 * * *"),
+			Entry("day out of range", "* * 0 * *"),
+			Entry("month out of range", "* * * 13 *"),
+			Entry("weekday out of range", "* * * * 8"),
+			Entry("zero step", "*/0 * * * *"),
+			Entry("backwards range", "5-1 * * * *"),
+			Entry("not a number", "a * * * *"),
+		)
+
+		It("treats Sunday as 7 and as 0", func() {
+			cs, _ := ParseCron("0 0 * * 7")
+			Expect(cs.Dow & 1).ToNot(BeZero())
+		}) // It
+
+		It("steps from the start of the range", func() {
+			cs, _ := ParseCron("5/20 * * * *")
+			Expect(cs.Minute).To(Equal(uint64(1<<5 | 1<<25 | 1<<45)))
+		}) // It
+	}) // Context
+
+	Context("Next", func() {
+		next := func(expr string, after time.Time) time.Time {
+			cs, err := ParseCron(expr)
+			Expect(err).ToNot(HaveOccurred())
+			when, ok := cs.Next(after)
+			Expect(ok).To(BeTrue())
+			return when
+		}
+
+		DescribeTable("finds the next run",
+			func(expr string, after string, run string) {
+				from, _ := time.Parse(clock, after)
+				want, _ := time.Parse(clock, run)
+				Expect(next(expr, from)).To(BeTemporally("==", want))
+			},
+			Entry("next minute", "* * * * *", "2026-05-04 10:15", "2026-05-04 10:16"),
+			Entry("later today", "30 14 * * *", "2026-05-04 10:15", "2026-05-04 14:30"),
+			Entry("tomorrow", "30 9 * * *", "2026-05-04 10:15", "2026-05-05 09:30"),
+			Entry("weekdays", "0 9 * * 1-5", "2026-05-08 10:00", "2026-05-11 09:00"),
+			Entry("next month", "0 0 1 * *", "2026-05-04 10:15", "2026-06-01 00:00"),
+			Entry("next year", "0 0 1 1 *", "2026-05-04 10:15", "2027-01-01 00:00"),
+			Entry("leap day", "0 0 29 2 *", "2026-05-04 10:15", "2028-02-29 00:00"),
+			Entry("either day field", "0 0 13 * 5", "2026-05-04 10:15", "2026-05-08 00:00"),
+		)
+
+		It("drops the seconds", func() {
+			from := time.Date(2026, 5, 4, 10, 15, 30, 0, time.UTC)
+			Expect(next("* * * * *", from)).To(BeTemporally("==", time.Date(2026, 5, 4, 10, 16, 0, 0, time.UTC)))
+		}) // It
+
+		It("never finds a day that doesn't exist", func() {
+			cs, _ := ParseCron("0 0 31 2 *")
+			_, ok := cs.Next(time.Date(2026, 5, 4, 10, 15, 0, 0, time.UTC))
+			Expect(ok).To(BeFalse(), "The 31st of February was found.")
+		}) // It
+
+		// Daylight saving time starts on March 8, 2026 and ends on November 1, 2026.
+		Context("Across Daylight Saving Time", func() {
+			var (
+				ny *time.Location
+			)
+
+			BeforeEach(func() {
+				var err error
+				if ny, err = time.LoadLocation("America/New_York"); err != nil {
+					Skip("no time zone data")
+				}
+			}) // BeforeEach
+
+			DescribeTable("runs by the wall clock",
+				func(expr string, after string, run string) {
+					from, _ := time.ParseInLocation(clock, after, ny)
+					want, _ := time.ParseInLocation(clock, run, ny)
+					Expect(next(expr, from)).To(BeTemporally("==", want))
+				},
+				Entry("skipped hour is skipped", "30 2 * * *", "2026-03-07 03:00", "2026-03-09 02:30"),
+				Entry("hourly across the skipped hour", "0 * * * *", "2026-03-08 01:30", "2026-03-08 03:00"),
+				Entry("after the skipped hour", "30 3 * * *", "2026-03-08 00:00", "2026-03-08 03:30"),
+				Entry("repeated hour runs once", "30 1 * * *", "2026-11-01 00:00", "2026-11-01 01:30"),
+				Entry("repeated hour doesn't run again", "30 1 * * *", "2026-11-01 01:45", "2026-11-02 01:30"),
+			)
+
+			It("runs hourly through the repeated hour", func() {
+				from, _ := time.ParseInLocation(clock, "2026-11-01 01:00", ny)
+				Expect(next("0 * * * *", from)).To(BeTemporally("==", from.Add(time.Hour)))
+			}) // It
+		}) // Context
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,80 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("Retry", func() {
+
+	const ms = time.Millisecond
+
+	AfterEach(func() {
+		appConfig.RetryBaseMs, appConfig.RetryMaxMs = 0, 0
+	}) // AfterEach
+
+	// Slack sends Retry-After either as seconds or as a date.
+	Context("Parse Retry After", func() {
+		DescribeTable("reads the delay",
+			func(value string, delay time.Duration) {
+				Expect(ParseRetryAfter(value)).To(Equal(delay))
+			},
+			Entry("missing", "", time.Duration(0)),
+			Entry("seconds", "3", 3*time.Second),
+			Entry("zero", "0", time.Duration(0)),
+			Entry("negative", "-5", time.Duration(0)),
+			Entry("garbage", "soon", time.Duration(0)),
+			Entry("date in the past", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), time.Duration(0)),
+		)
+
+		// The date form only has whole seconds, so allow for the clock moving on.
+		It("reads a date in the future", func() {
+			when := time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)
+			Expect(ParseRetryAfter(when)).To(BeNumerically("~", 89*time.Second, time.Second))
+		}) // It
+	}) // Context
+
+	// The delay is jittered, so try each case a few times.
+	Context("Retry Delay", func() {
+		DescribeTable("backs off between attempts",
+			func(base int, max int, attempt int, retryAfter time.Duration, lo time.Duration, hi time.Duration) {
+				appConfig.RetryBaseMs, appConfig.RetryMaxMs = base, max
+				for i := 0; i < 20; i++ {
+					delay := RetryDelay(attempt, retryAfter)
+					Expect(delay).To(BeNumerically(">=", lo))
+					Expect(delay).To(BeNumerically("<=", hi))
+				} // for
+			},
+			Entry("first retry", 0, 0, 1, time.Duration(0), 250*ms, 500*ms),
+			Entry("doubles", 0, 0, 3, time.Duration(0), 1000*ms, 2000*ms),
+			Entry("capped", 0, 0, 20, time.Duration(0), 30*time.Second, 60*time.Second),
+			Entry("huge attempt", 0, 0, 100, time.Duration(0), 30*time.Second, 60*time.Second),
+			Entry("configured", 100, 1000, 2, time.Duration(0), 100*ms, 200*ms),
+			Entry("configured cap", 100, 1000, 8, time.Duration(0), 500*ms, 1000*ms),
+			Entry("retry after wins", 0, 0, 1, 7*time.Second, 7*time.Second, 7*time.Second),
+			Entry("retry after is capped", 0, 0, 1, time.Hour, 60*time.Second, 60*time.Second),
+			Entry("retry after under the configured cap", 100, 1000, 1, 2*time.Second, 1000*ms, 1000*ms),
+		)
+	}) // Context
+
+	// Only trouble on Slack's end is worth another try.
+	Context("Retryable", func() {
+		DescribeTable("decides whether to try again",
+			func(attempt DeliveryAttempt, retryable bool) {
+				Expect(attempt.Retryable()).To(Equal(retryable))
+			},
+			Entry("connection error", DeliveryAttempt{Error: "connection refused"}, true),
+			Entry("rate limited", DeliveryAttempt{StatusCode: 429}, true),
+			Entry("server error", DeliveryAttempt{StatusCode: 500}, true),
+			Entry("unavailable", DeliveryAttempt{StatusCode: 503}, true),
+			Entry("bad payload", DeliveryAttempt{StatusCode: 400, Response: "invalid_payload"}, false),
+			Entry("not found", DeliveryAttempt{StatusCode: 404}, false),
+			Entry("delivered", DeliveryAttempt{StatusCode: 200}, false),
+			Entry("nothing happened", DeliveryAttempt{}, false),
+		)
+	}) // Context
+
+}) // Describe
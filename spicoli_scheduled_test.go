@@ -0,0 +1,65 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Scheduled", func() {
+
+	var (
+		dir   string
+		saved string
+	)
+
+	// Whether the message would still be replayed from the queue log.
+	pending := func(id string) bool {
+		for _, entry := range PendingQueueLog() {
+			if entry.Id == id {
+				return true
+			}
+		} // for
+		return false
+	}
+
+	// Keep the schedule in a scratch directory.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "scheduled")
+		saved = scheduledFile
+		scheduledFile = filepath.Join(dir, "scheduled.json")
+	}) // BeforeEach
+
+	AfterEach(func() {
+		scheduledLock.Lock()
+		scheduledFile = saved
+		scheduled = nil
+		scheduledLock.Unlock()
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	It("takes a message out of the queue log once the schedule is saved", func() {
+		doc := SlackMessageIn{Id: "scheduled-saved", Key: "key", SendAt: "2030-01-01T00:00:00Z"}
+		Expect(LogInbound(doc)).To(Succeed())
+		ScheduleMessage(doc)
+
+		Expect(pending(doc.Id)).To(BeFalse())
+		Expect(LoadScheduled()).To(BeTrue())
+		Expect(scheduled).To(HaveKey(doc.Id))
+		_, err := os.Stat(scheduledFile + ".tmp")
+		Expect(os.IsNotExist(err)).To(BeTrue(), "The temporary file was left behind.")
+	}) // It
+
+	It("leaves a message in the queue log if the schedule can't be saved", func() {
+		scheduledFile = filepath.Join(dir, "missing", "scheduled.json")
+		doc := SlackMessageIn{Id: "scheduled-unsaved", Key: "key", SendAt: "2030-01-01T00:00:00Z"}
+		Expect(LogInbound(doc)).To(Succeed())
+		ScheduleMessage(doc)
+
+		Expect(pending(doc.Id)).To(BeTrue(), "The message would be lost in a crash.")
+		LogDone(doc.Id)
+	}) // It
+
+}) // Describe
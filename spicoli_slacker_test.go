@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Slacker", func() {
+
+	// Slackers saved before is_active was honored leave it out, and are active.
+	Context("Is Active", func() {
+		DescribeTable("reads the is_active flag",
+			func(saved string, active bool) {
+				var sc SlackConfig
+				Expect(json.Unmarshal([]byte(saved), &sc)).To(Succeed())
+				Expect(sc.IsActive()).To(Equal(active))
+			},
+			Entry("left out", `{"key":"k"}`, true),
+			Entry("on", `{"key":"k","is_active":true}`, true),
+			Entry("off", `{"key":"k","is_active":false}`, false),
+		)
+
+		It("keeps a slacker off when it is saved", func() {
+			var sc SlackConfig
+			Expect(json.Unmarshal([]byte(`{"key":"k","is_active":false}`), &sc)).To(Succeed())
+			saved, _ := json.Marshal(sc)
+			Expect(string(saved)).To(ContainSubstring(`"is_active":false`))
+		}) // It
+	}) // Context
+
+	// A message can ask for a channel, but only its slacker's own or one it allows.
+	Context("Allows Channel", func() {
+		sc := SlackConfig{AllowedChannels: []string{"#Deploys", "alerts"}}
+		sc.SlackData.Channel = "#ops"
+
+		DescribeTable("checks the channel asked for",
+			func(channel string, allowed bool) {
+				Expect(sc.AllowsChannel(channel)).To(Equal(allowed))
+			},
+			Entry("its own channel", "#ops", true),
+			Entry("its own channel without the #", "ops", true),
+			Entry("its own channel in another case", "#OPS", true),
+			Entry("an allowed channel", "#deploys", true),
+			Entry("an allowed channel without the #", "deploys", true),
+			Entry("an allowed channel saved without the #", "#alerts", true),
+			Entry("an allowed channel in another case", "ALERTS", true),
+			Entry("another channel", "#general", false),
+			Entry("a channel that only starts the same", "#ops-private", false),
+			Entry("nothing", "", false),
+		)
+
+		It("allows only its own channel without an allowlist", func() {
+			own := SlackConfig{}
+			own.SlackData.Channel = "#ops"
+			Expect(own.AllowsChannel("#ops")).To(BeTrue())
+			Expect(own.AllowsChannel("#deploys")).To(BeFalse())
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -34,18 +34,41 @@ var _ = BeforeSuite(func() {
 	// Startup a concurrent process to handle various system
 	// events during execution.  Typically these are for notifications
 	// and any other things that need to be dispatched.
+	MakeQueues()
+	OpenQueueLog()
+	StartOutboundWorkers()
     go func() {
 		for {
 			select {
 			case <-GetInboundNotifier():
 				DepleteInboundList()
-			case <-GetOutboundNotifier():
-				DepleteOutboundList()
+			case <-GetDispatchTicker():
+				ReleaseDigests()
+				ReleaseQuietHours()
+				ReleaseScheduled()
+				FireRecurring()
 			case <-GetFlushTicker():
 				FlushSlackers()
+				FlushGroups()
+				FlushTemplates()
+				FlushDirectory()
 				FlushRequests()
+				FlushDeadLetters()
+				FlushIdempotencyKeys()
+				FlushScheduled()
+				FlushRecurring()
 				LoadSlackers()
+				LoadGroups()
+				LoadTemplates()
+				LoadDirectory()
 				LoadRequests()
+				LoadDeadLetters()
+				LoadIdempotencyKeys()
+				LoadScheduled()
+				LoadRecurring()
+				PruneMessageStatuses()
+				PruneOverflow()
+				CompactQueueLog()
 			}
 		}
 	}()
@@ -0,0 +1,74 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Templates", func() {
+
+	var (
+		dir            string
+		savedFile      string
+		savedTemplates map[string]MessageTemplate
+	)
+
+	// Keep the templates in a scratch directory.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "templates")
+		templateLock.Lock()
+		savedFile, savedTemplates = templateFile, templates
+		templateFile = filepath.Join(dir, "templates.json")
+		templates = nil
+		templateLock.Unlock()
+	}) // BeforeEach
+
+	AfterEach(func() {
+		templateLock.Lock()
+		templateFile, templates = savedFile, savedTemplates
+		templateLock.Unlock()
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	// The main loop saves and then reloads the templates.  A template added in between
+	// has to survive the reload.
+	Context("Reload", func() {
+		It("keeps a template added since the last save", func() {
+			FlushTemplates()
+			rsp := httptest.NewRecorder()
+			code, _ := AddTemplate(MessageTemplate{Name: "Plain", Text: "{{.Text}}"}, rsp)
+			Expect(code).To(Equal(http.StatusCreated))
+
+			Expect(LoadTemplates()).To(BeTrue())
+			Expect(templates).To(HaveLen(1))
+		}) // It
+
+		It("doesn't bring back a template deleted since the last save", func() {
+			AddTemplate(MessageTemplate{Name: "Plain", Text: "{{.Text}}"}, httptest.NewRecorder())
+			FlushTemplates()
+			for id := range templates {
+				code, _ := DeleteTemplate(map[string]string{"template_id": id})
+				Expect(code).To(Equal(http.StatusOK))
+			} // for
+
+			Expect(LoadTemplates()).To(BeTrue())
+			Expect(templates).To(BeEmpty())
+		}) // It
+	}) // Context
+
+	Context("Validate", func() {
+		It("accepts a template using the message", func() {
+			Expect(ValidateTemplate(MessageTemplate{Text: "{{.Slacker}} on {{.Channel}}: {{.Text}}"})).To(BeEmpty())
+		}) // It
+
+		It("turns away a template asking for the slacker's key", func() {
+			Expect(ValidateTemplate(MessageTemplate{Text: "{{.Key}}: {{.Text}}"})).To(HavePrefix("Bad template"))
+		}) // It
+	}) // Context
+
+}) // Describe
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Queue Log", func() {
+
+	var (
+		dir   string
+		saved string
+	)
+
+	// Stop writing without compacting or closing down properly, the way a crash would.
+	crash := func() {
+		queueLogLock.Lock()
+		queueLog.Close()
+		queueLog = nil
+		queuePending = nil
+		queueLogLock.Unlock()
+	}
+
+	// The ids of the messages that would be replayed, in order.
+	pendingIds := func() []string {
+		ids := []string{}
+		for _, entry := range PendingQueueLog() {
+			ids = append(ids, entry.Id)
+		} // for
+		return ids
+	}
+
+	// The ids on each line of the log file.
+	loggedIds := func() []string {
+		file, err := os.Open(queueLogFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		ids := []string{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry QueueLogEntry
+			Expect(json.Unmarshal(scanner.Bytes(), &entry)).To(Succeed())
+			ids = append(ids, entry.Id)
+		} // for
+		return ids
+	}
+
+	// Keep the log in a scratch directory, then go back to the suite's own log.
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "queuelog")
+		saved = queueLogFile
+		crash()
+		queueLogFile = filepath.Join(dir, "queue.log")
+		OpenQueueLog()
+	}) // BeforeEach
+
+	AfterEach(func() {
+		crash()
+		queueLogFile = saved
+		OpenQueueLog()
+		os.RemoveAll(dir)
+	}) // AfterEach
+
+	It("replays unfinished messages after a crash", func() {
+		Expect(LogInbound(SlackMessageIn{Id: "accepted", Text: "one"})).To(Succeed())
+		Expect(LogInbound(SlackMessageIn{Id: "moved", Text: "two"})).To(Succeed())
+		Expect(LogInbound(SlackMessageIn{Id: "sent", Text: "three"})).To(Succeed())
+		Expect(LogOutbound(SlackMessageOut{Id: "moved"})).To(Succeed())
+		LogDone("sent")
+
+		crash()
+		OpenQueueLog()
+		pending := PendingQueueLog()
+		Expect(pending).To(HaveLen(2))
+		Expect(pending[0].Id).To(Equal("accepted"))
+		Expect(pending[0].Inbound).ToNot(BeNil())
+		Expect(pending[1].Id).To(Equal("moved"), "A message should keep its place in line when it moves to outbound.")
+		Expect(pending[1].Outbound).ToNot(BeNil())
+	}) // It
+
+	It("compacts down to the unfinished messages", func() {
+		for _, id := range []string{"one", "two", "three", "four"} {
+			Expect(LogInbound(SlackMessageIn{Id: id})).To(Succeed())
+		} // for
+		LogDone("one")
+		LogDone("three")
+		Expect(loggedIds()).To(HaveLen(6))
+
+		CompactQueueLog()
+		Expect(loggedIds()).To(Equal([]string{"two", "four"}))
+		Expect(pendingIds()).To(Equal([]string{"two", "four"}))
+
+		// The compacted log is still the one being written to.
+		Expect(LogInbound(SlackMessageIn{Id: "five"})).To(Succeed())
+		crash()
+		OpenQueueLog()
+		Expect(pendingIds()).To(Equal([]string{"two", "four", "five"}))
+	}) // It
+
+	It("skips a torn last line", func() {
+		Expect(LogInbound(SlackMessageIn{Id: "whole"})).To(Succeed())
+		crash()
+		file, err := os.OpenFile(queueLogFile, os.O_APPEND|os.O_WRONLY, 0644)
+		Expect(err).ToNot(HaveOccurred())
+		file.WriteString(`{"op":"in","id":"torn","inbound":{"id":"to`)
+		file.Close()
+
+		OpenQueueLog()
+		Expect(pendingIds()).To(Equal([]string{"whole"}))
+		Expect(LogInbound(SlackMessageIn{Id: "after"})).To(Succeed())
+		Expect(loggedIds()).To(Equal([]string{"whole", "after"}), "The torn line should be gone after opening.")
+	}) // It
+
+	It("doesn't replay messages logged after it was opened", func() {
+		Expect(LogInbound(SlackMessageIn{Id: "left over"})).To(Succeed())
+		crash()
+		OpenQueueLog()
+		pending := PendingQueueLog()
+		Expect(LogInbound(SlackMessageIn{Id: "new"})).To(Succeed())
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].Id).To(Equal("left over"))
+	}) // It
+
+}) // Describe
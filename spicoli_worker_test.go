@@ -0,0 +1,110 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Worker", func() {
+
+	var (
+		lock  sync.Mutex
+		order []string
+	)
+
+	record := func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+		order = append(order, name)
+	}
+
+	recorded := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), order...)
+	}
+
+	BeforeEach(func() {
+		order = nil
+	}) // BeforeEach
+
+	// A hook told to back off is parked, and the worker gets on with the others.
+	It("serves other hooks while one waits", func() {
+		throttled := false
+		slow := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			first := !throttled
+			throttled = true
+			lock.Unlock()
+			if first {
+				record("slow 429")
+				rsp.Header().Set("Retry-After", "1")
+				rsp.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			record("slow")
+		}))
+		defer slow.Close()
+		fast := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+			record("fast")
+		}))
+		defer fast.Close()
+
+		lanes := NewOutboundLanes(10)
+		lanes.Put(SlackMessageOut{Id: "slow", Hook: slow.URL, IsNotification: true})
+		lanes.Put(SlackMessageOut{Id: "fast", Hook: fast.URL, IsNotification: true})
+		w := &outboundWorker{lanes: lanes, waiting: make(map[string]*hookQueue)}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(recorded()) < 3 && time.Now().Before(deadline) {
+			w.step()
+		} // for
+		Expect(recorded()).To(Equal([]string{"slow 429", "fast", "slow"}))
+	}) // It
+
+	// Posts for a hook whose breaker is open wait for the probe instead of being
+	// dead lettered, and the other hooks keep going meanwhile.
+	It("holds a hook's posts while its breaker is open", func() {
+		appConfig.BreakerCooldownSeconds = 1
+		defer func() { appConfig.BreakerCooldownSeconds = 0 }()
+
+		down := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+			record("down")
+		}))
+		defer down.Close()
+		up := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+			record("up")
+		}))
+		defer up.Close()
+
+		failed := SlackMessageOut{Id: "failed", Hook: down.URL, IsNotification: true}
+		failed.Attempts = []DeliveryAttempt{{StatusCode: 503}}
+		for i := 0; i < DEFAULT_BREAKER_THRESHOLD; i++ {
+			RecordDelivery(failed, false)
+		} // for
+
+		lanes := NewOutboundLanes(10)
+		lanes.Put(SlackMessageOut{Id: "down-1", Hook: down.URL, IsNotification: true})
+		lanes.Put(SlackMessageOut{Id: "down-2", Hook: down.URL, IsNotification: true})
+		lanes.Put(SlackMessageOut{Id: "up", Hook: up.URL, IsNotification: true})
+		w := &outboundWorker{lanes: lanes, waiting: make(map[string]*hookQueue)}
+
+		for i := 0; i < 3; i++ {
+			w.step()
+		} // for
+		Expect(recorded()).To(Equal([]string{"up"}))
+		Expect(w.waiting).To(HaveKey(down.URL))
+		Expect(w.waiting[down.URL].posts).To(HaveLen(2))
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(recorded()) < 3 && time.Now().Before(deadline) {
+			w.step()
+		} // for
+		Expect(recorded()).To(Equal([]string{"up", "down", "down"}))
+	}) // It
+
+}) // Describe
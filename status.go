@@ -0,0 +1,163 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The states a message moves through on its way to Slack.
+const (
+	STATE_QUEUED        = "queued"
+	STATE_SENDING       = "sending"
+	STATE_RETRYING      = "retrying"
+	STATE_SCHEDULED     = "scheduled"
+	STATE_HELD          = "held"
+	STATE_DELIVERED     = "delivered"
+	STATE_FAILED        = "failed"
+	STATE_DEAD_LETTERED = "dead-lettered"
+	STATE_COALESCED     = "coalesced"
+	STATE_CANCELLED     = "cancelled"
+	STATE_EXPIRED       = "expired"
+	STATE_FANNED_OUT    = "fanned-out" // sent to a group, see the legs
+)
+
+// How long the status of a finished message is kept around for callers to look at.
+const STATUS_RETENTION = 24 * time.Hour
+
+var (
+	statuses   map[string]*MessageStatus
+	statusLock sync.Mutex
+)
+
+// MessageStatus is what the caller gets back when they ask about a message.
+type MessageStatus struct {
+	Id         string     `json:"id"`
+	State      string     `json:"state"`
+	Reason     string     `json:"reason,omitempty"`
+	Attempts   int        `json:"attempts"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Response   string     `json:"response,omitempty"`
+	Created    time.Time  `json:"created"`
+	Updated    time.Time  `json:"updated"`
+	Delivered  *time.Time `json:"delivered,omitempty"`
+	Legs       []string   `json:"legs,omitempty"` // for a message sent to a group
+}
+
+// Receipt is the body returned when a message is accepted.
+type Receipt struct {
+	Id     string   `json:"id"`
+	Status string   `json:"status"`
+	Legs   []string `json:"legs,omitempty"` // for a message sent to a group
+}
+
+// IsFinished tells the caller if the message is done moving.
+func (ms *MessageStatus) IsFinished() bool {
+	switch ms.State {
+	case STATE_DELIVERED, STATE_FAILED, STATE_DEAD_LETTERED, STATE_COALESCED, STATE_CANCELLED, STATE_EXPIRED, STATE_FANNED_OUT:
+		return true
+	}
+	return false
+} // func
+
+// GetMessageStatus reports where a message is in its trip to Slack.
+func GetMessageStatus(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	statusLock.Lock()
+	ms, ok := statuses[params["message_id"]]
+	var copy MessageStatus
+	if ok {
+		copy = *ms
+	}
+	statusLock.Unlock()
+	if !ok {
+		return http.StatusNotFound, "Message does not exist."
+	}
+	return JsonResponse(rsp, http.StatusOK, copy)
+} // func
+
+// MessageLegs returns the legs of a message sent to a group, as long as its status is
+// still around.
+func MessageLegs(id string) []string {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if ms, ok := statuses[id]; ok {
+		return ms.Legs
+	}
+	return nil
+} // func
+
+// PruneMessageStatuses forgets about messages that finished a while ago.
+func PruneMessageStatuses() {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	cutoff := time.Now().UTC().Add(-STATUS_RETENTION)
+	for id, ms := range statuses {
+		if ms.IsFinished() && ms.Updated.Before(cutoff) {
+			delete(statuses, id)
+		}
+	} // for
+} // func
+
+// RecordAttempt notes the outcome of a post to Slack against the message.
+func RecordAttempt(id string, attempt DeliveryAttempt, state string) {
+	updateMessageStatus(id, func(ms *MessageStatus) {
+		ms.State = state
+		ms.Attempts++
+		ms.StatusCode = attempt.StatusCode
+		ms.Response = attempt.Response
+		ms.Reason = attempt.Error
+		if state == STATE_DELIVERED {
+			ms.Delivered = &attempt.Time
+		}
+	})
+} // func
+
+// SetMessageLegs notes the legs a message sent to a group was split into.
+func SetMessageLegs(id string, legs []string) {
+	updateMessageStatus(id, func(ms *MessageStatus) {
+		ms.Legs = legs
+	})
+} // func
+
+// SetMessageState moves the message to a new state.  The reason is optional.
+func SetMessageState(id string, state string, reason string) {
+	updateMessageStatus(id, func(ms *MessageStatus) {
+		ms.State = state
+		if reason != "" {
+			ms.Reason = reason
+		}
+	})
+} // func
+
+// TrackMessage starts keeping track of a newly accepted message.
+func TrackMessage(id string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if statuses == nil {
+		statuses = make(map[string]*MessageStatus)
+	}
+	now := time.Now().UTC()
+	statuses[id] = &MessageStatus{Id: id, State: STATE_QUEUED, Created: now, Updated: now}
+} // func
+
+// updateMessageStatus applies the change to the status if we are tracking it.  A
+// message can outlive its status (a dead letter replayed days later, for instance),
+// in which case tracking starts over.
+func updateMessageStatus(id string, change func(*MessageStatus)) {
+	if id == "" {
+		return
+	}
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if statuses == nil {
+		statuses = make(map[string]*MessageStatus)
+	}
+	ms, ok := statuses[id]
+	if !ok {
+		ms = &MessageStatus{Id: id, Created: time.Now().UTC()}
+		statuses[id] = ms
+	}
+	change(ms)
+	ms.Updated = time.Now().UTC()
+} // func
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"github.com/pborman/uuid"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	templateFile string
+	templates    map[string]MessageTemplate
+	templateLock sync.RWMutex
+)
+
+// MessageTemplate lays out the text of a slacker's posts.  The template uses Go's
+// text/template syntax and is given a TemplateData.
+type MessageTemplate struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Text        string `json:"text"`
+}
+
+// TemplateData is what a template has to work with.  The slacker's key is left out
+// on purpose, it is the only thing keeping others from posting as the slacker.
+type TemplateData struct {
+	Id       string
+	Action   string
+	Priority string
+	Text     string
+	Slacker  string    // the slacker's name
+	Channel  string    // where the message is going
+	Time     time.Time // when the message was accepted
+	Vars     map[string]interface{}
+}
+
+// Rendered is the body returned by a dry render.
+type Rendered struct {
+	Text string `json:"text"`
+}
+
+// AddTemplate saves a new template once it has been shown to work.
+func AddTemplate(mt MessageTemplate, rsp http.ResponseWriter) (int, string) {
+	if msg := ValidateTemplate(mt); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	mt.Id = uuid.New()
+
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	if templates == nil {
+		templates = make(map[string]MessageTemplate)
+	}
+	templates[mt.Id] = mt
+	writeTemplates()
+	return JsonResponse(rsp, http.StatusCreated, mt)
+} // func
+
+// DeleteTemplate removes a template, as long as no slacker is using it.
+func DeleteTemplate(params martini.Params) (int, string) {
+	id := params["template_id"]
+	if users := TemplateUsers(id); users > 0 {
+		return http.StatusConflict, "Template is in use by slackers."
+	}
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	if _, ok := templates[id]; !ok {
+		return http.StatusNotFound, "Template does not exist."
+	}
+	delete(templates, id)
+	writeTemplates()
+	return http.StatusOK, "Template deleted."
+} // func
+
+// FlushTemplates will write all of the templates to disk.
+func FlushTemplates() {
+	templateLock.RLock()
+	defer templateLock.RUnlock()
+	writeTemplates()
+} // func
+
+// writeTemplates does the actual work of saving the templates.  It is done whenever a
+// template changes, so the file is never behind when it is reloaded.  The caller must
+// be holding the lock.
+func writeTemplates() {
+	file, err := os.Create(templateFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	// Let's make the JSON pretty.
+	buf, err := json.MarshalIndent(templates, "", "  ")
+	if err != nil {
+		log.Printf("error: Could not encode Templates JSON/%s", err.Error())
+		return
+	}
+
+	// Now output the lot.
+	out := bytes.NewBuffer(buf)
+	_, err = out.WriteTo(file)
+	if err != nil {
+		log.Printf("error: Could not write to buffer/%s", err.Error())
+	}
+} // func
+
+// GetTemplate returns a single template.
+func GetTemplate(params martini.Params, rsp http.ResponseWriter) (int, string) {
+	templateLock.RLock()
+	mt, ok := templates[params["template_id"]]
+	templateLock.RUnlock()
+	if !ok {
+		return http.StatusNotFound, "Template does not exist."
+	}
+	return JsonResponse(rsp, http.StatusOK, mt)
+} // func
+
+// ListTemplates returns all of the templates, by name.
+func ListTemplates(rsp http.ResponseWriter) (int, string) {
+	templateLock.RLock()
+	list := []MessageTemplate{}
+	for _, mt := range templates {
+		list = append(list, mt)
+	} // for
+	templateLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return JsonResponse(rsp, http.StatusOK, list)
+} // func
+
+// LoadTemplates reads the templates from disk.
+func LoadTemplates() bool {
+	file, err := os.Open(templateFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	loaded := make(map[string]MessageTemplate)
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&loaded)
+	if err != nil {
+		log.Printf("error: Could not decode Templates JSON/%s", err.Error())
+		return false
+	}
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	templates = loaded
+	log.Printf("info: Loaded %d Templates from disk.", len(templates))
+	return true
+} // func
+
+// RenderMessage lays out the message's text with the slacker's template, if it has
+// one.  A template that fails leaves the text as it was sent rather than lose the
+// message.
+func RenderMessage(doc SlackMessageIn, scfg SlackConfig) SlackMessageIn {
+	if scfg.MessageTemplateId == "" {
+		return doc
+	}
+	templateLock.RLock()
+	mt, ok := templates[scfg.MessageTemplateId]
+	templateLock.RUnlock()
+	if !ok {
+		log.Printf("error: Template %s for %s does not exist", scfg.MessageTemplateId, SlackerLabel(scfg, doc.Key))
+		return doc
+	}
+	text, err := renderTemplate(mt, doc, scfg)
+	if err != nil {
+		log.Printf("error: Could not render template %s/%s", mt.Id, err.Error())
+		return doc
+	}
+	doc.Text = text
+	return doc
+} // func
+
+// RenderTemplate does a dry render of the template with the message sent in, without
+// sending anything.  The slacker named by the message's key, if any, fills in the
+// slacker's name and channel.  The result is formatted the way it would be sent.
+func RenderTemplate(doc SlackMessageIn, params martini.Params, rsp http.ResponseWriter) (int, string) {
+	templateLock.RLock()
+	mt, ok := templates[params["template_id"]]
+	templateLock.RUnlock()
+	if !ok {
+		return http.StatusNotFound, "Template does not exist."
+	}
+	if doc.Accepted.IsZero() {
+		doc.Accepted = time.Now().UTC()
+	}
+	text, err := renderTemplate(mt, doc, GetSlacker(doc.Key))
+	if err != nil {
+		return http.StatusBadRequest, "Could not render template, " + err.Error() + "."
+	}
+	doc.Text = text
+	return JsonResponse(rsp, http.StatusOK, Rendered{Text: ResolveMentions(FormatMessage(doc)).Text})
+} // func
+
+// TemplateUsers counts the slackers using the template.
+func TemplateUsers(id string) int {
+	slackerLock.RLock()
+	defer slackerLock.RUnlock()
+	z := 0
+	for _, sc := range slackers {
+		if sc.MessageTemplateId == id {
+			z++
+		}
+	} // for
+	return z
+} // func
+
+// UpdateTemplate replaces a template once the new one has been shown to work.
+func UpdateTemplate(mt MessageTemplate, params martini.Params, rsp http.ResponseWriter) (int, string) {
+	if msg := ValidateTemplate(mt); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	if _, ok := templates[params["template_id"]]; !ok {
+		return http.StatusNotFound, "Template does not exist."
+	}
+	mt.Id = params["template_id"]
+	templates[mt.Id] = mt
+	writeTemplates()
+	return JsonResponse(rsp, http.StatusOK, mt)
+} // func
+
+// ValidTemplateId tells the caller if the template exists.
+func ValidTemplateId(id string) bool {
+	templateLock.RLock()
+	defer templateLock.RUnlock()
+	_, ok := templates[id]
+	return ok
+} // func
+
+// ValidateTemplate makes sure the template parses and renders a sample message, so a
+// bad one is caught before it is used.  It returns what is wrong, if anything.
+func ValidateTemplate(mt MessageTemplate) string {
+	if mt.Text == "" {
+		return "Template text not provided."
+	}
+	sample := SlackMessageIn{
+		Id:       uuid.New(),
+		Key:      uuid.New(),
+		Action:   "info",
+		Priority: "normal",
+		Text:     "Sample text",
+		Accepted: time.Now().UTC(),
+	}
+	scfg := SlackConfig{Name: "Sample slacker"}
+	scfg.SlackData.Channel = "#sample"
+	if _, err := renderTemplate(mt, sample, scfg); err != nil {
+		return "Bad template, " + err.Error() + "."
+	}
+	return ""
+} // func
+
+// renderTemplate runs the message through the template.
+func renderTemplate(mt MessageTemplate, doc SlackMessageIn, scfg SlackConfig) (string, error) {
+	tmpl, err := template.New(mt.Id).Parse(mt.Text)
+	if err != nil {
+		return "", err
+	}
+	data := TemplateData{
+		Id:       doc.Id,
+		Action:   doc.Action,
+		Priority: doc.Priority,
+		Text:     doc.Text,
+		Slacker:  scfg.Name,
+		Channel:  scfg.SlackData.Channel,
+		Time:     doc.Accepted,
+		Vars:     doc.Vars,
+	}
+	if doc.Channel != "" {
+		data.Channel = doc.Channel
+	}
+	if data.Vars == nil {
+		data.Vars = make(map[string]interface{})
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+} // func
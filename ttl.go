@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ExpiresAt works out when the message goes stale.  The clock starts when the message
+// was accepted, or when it was scheduled for if that is later.  A zero time means it
+// never does.
+func ExpiresAt(doc SlackMessageIn, scfg SlackConfig) time.Time {
+	ttl := doc.TTLSeconds
+	if ttl <= 0 {
+		ttl = scfg.DefaultTTLSeconds
+	}
+	if ttl <= 0 || doc.Accepted.IsZero() {
+		return time.Time{}
+	}
+	start := doc.Accepted
+	if due := DueTime(doc); due.After(start) {
+		start = due
+	}
+	return start.Add(time.Duration(ttl) * time.Second).UTC()
+} // func
+
+// ExpireInbound gets rid of a message that went stale before it could be matched up
+// with its slacker.
+func ExpireInbound(doc SlackMessageIn, scfg SlackConfig, expires time.Time) {
+	reason := expiredReason(expires)
+	log.Printf("warn: Message %s for %s expired", doc.Id, SlackerLabel(scfg, doc.Key))
+	if scfg.DropExpired {
+		SetMessageState(doc.Id, STATE_EXPIRED, reason)
+		LogDone(doc.Id)
+		return
+	}
+	AddDeadLetter(reason, doc.Key, &doc, nil)
+} // func
+
+// ExpireOutbound gets rid of a post that went stale while it waited for a worker.
+func ExpireOutbound(doc SlackMessageOut) {
+	reason := expiredReason(doc.Expires)
+	scfg := GetSlacker(doc.Key)
+	log.Printf("warn: Message %s for %s expired", doc.Id, SlackerLabel(scfg, doc.Key))
+	if scfg.DropExpired {
+		SetMessageState(doc.Id, STATE_EXPIRED, reason)
+		LogDone(doc.Id)
+		return
+	}
+	AddDeadLetter(reason, doc.Key, nil, &doc)
+} // func
+
+// IsExpired tells the caller if the expiry time has passed.
+func IsExpired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+} // func
+
+// expiredReason says why the message was dropped.
+func expiredReason(expires time.Time) string {
+	return "Time to live ran out at " + expires.Format(time.RFC3339)
+} // func
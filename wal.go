@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Queue log operations.  A message is logged when it is accepted, logged again when
+// it moves to the outbound list, and marked done once it has been dealt with.
+const (
+	LOG_INBOUND  = "in"
+	LOG_OUTBOUND = "out"
+	LOG_DONE     = "done"
+)
+
+var (
+	queueLogFile string
+	queueLog     *os.File
+	queueLogLock sync.Mutex
+	queuePending map[string]QueueLogEntry
+)
+
+// QueueLogEntry is a single line in the queue log.
+type QueueLogEntry struct {
+	Op       string           `json:"op"`
+	Id       string           `json:"id"`
+	Time     time.Time        `json:"time"`
+	Inbound  *SlackMessageIn  `json:"inbound,omitempty"`
+	Outbound *SlackMessageOut `json:"outbound,omitempty"`
+}
+
+// CompactQueueLog rewrites the queue log with only the messages that are still in
+// flight.  The new log is written off to the side and renamed over the old one so a
+// crash part way through never leaves us without a log.
+func CompactQueueLog() {
+	queueLogLock.Lock()
+	defer queueLogLock.Unlock()
+	if queueLog == nil {
+		return
+	}
+
+	tmpFile := queueLogFile + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		log.Printf("error: Unable to open file/%s", err.Error())
+		return
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range sortedPending() {
+		if err = encoder.Encode(entry); err != nil {
+			break
+		}
+	} // for
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		log.Printf("error: Could not write compacted queue log/%s", err.Error())
+		os.Remove(tmpFile)
+		return
+	}
+
+	if err = os.Rename(tmpFile, queueLogFile); err != nil {
+		log.Printf("error: Could not replace queue log/%s", err.Error())
+		return
+	}
+	queueLog.Close()
+	queueLog, err = os.OpenFile(queueLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("error: Unable to reopen queue log/%s", err.Error())
+		queueLog = nil
+		return
+	}
+	log.Printf("info: Compacted queue log to %d messages.", len(queuePending))
+} // func
+
+// LogDone marks the message as finished so it won't be replayed.
+func LogDone(id string) {
+	if err := appendQueueLog(QueueLogEntry{Op: LOG_DONE, Id: id}); err != nil {
+		log.Printf("error: Could not mark %s done in queue log/%s", id, err.Error())
+	}
+} // func
+
+// LogInbound records a message that was accepted and is about to go on the inbound list.
+func LogInbound(smi SlackMessageIn) error {
+	return appendQueueLog(QueueLogEntry{Op: LOG_INBOUND, Id: smi.Id, Inbound: &smi})
+} // func
+
+// LogOutbound records a message that is about to go on the outbound list.
+func LogOutbound(smo SlackMessageOut) error {
+	return appendQueueLog(QueueLogEntry{Op: LOG_OUTBOUND, Id: smo.Id, Outbound: &smo})
+} // func
+
+// OpenQueueLog reads whatever is in the queue log from the last run, works out which
+// messages never finished, and opens the log for appending.
+func OpenQueueLog() {
+	queueLogLock.Lock()
+	queuePending = make(map[string]QueueLogEntry)
+	file, err := os.Open(queueLogFile)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var entry QueueLogEntry
+			// A crash in the middle of a write leaves a partial last line.  There's
+			// nothing to be done for it, and we never sent a 202 for it either.
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				log.Printf("warn: Skipping bad queue log entry/%s", err.Error())
+				continue
+			}
+			applyQueueLog(entry)
+		} // for
+		file.Close()
+		log.Printf("info: Loaded %d unfinished messages from the queue log.", len(queuePending))
+	} else if !os.IsNotExist(err) {
+		log.Printf("error: Unable to open file/%s", err.Error())
+	}
+
+	queueLog, err = os.OpenFile(queueLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("error: Unable to open queue log/%s", err.Error())
+		queueLog = nil
+	}
+	queueLogLock.Unlock()
+
+	// Start the new run with only the messages that still matter.
+	CompactQueueLog()
+} // func
+
+// PendingQueueLog returns the messages the last run never finished, in the order they
+// were logged.  Call it right after OpenQueueLog, before anything new is logged, or new
+// messages would be replayed on top of being sent.
+func PendingQueueLog() []QueueLogEntry {
+	queueLogLock.Lock()
+	defer queueLogLock.Unlock()
+	return sortedPending()
+} // func
+
+// ReplayQueueLog puts the unfinished messages from the last run back on the queue they
+// were on.  The background processes have to be running since this waits for room on
+// the inbound list, so it is run in its own goroutine.
+func ReplayQueueLog(pending []QueueLogEntry) {
+	for _, entry := range pending {
+		SetMessageState(entry.Id, STATE_QUEUED, "Recovered from queue log")
+		if entry.Inbound != nil {
+			InboundList.PutWait(*entry.Inbound)
+			NotifyInboundList()
+		} else if entry.Outbound != nil {
+			HoldOutboundList(*entry.Outbound)
+		}
+	} // for
+	if len(pending) > 0 {
+		log.Printf("info: Replayed %d messages from the queue log.", len(pending))
+	}
+} // func
+
+// appendQueueLog writes the entry to the end of the queue log and makes sure it is on
+// disk before returning.
+func appendQueueLog(entry QueueLogEntry) error {
+	entry.Time = time.Now().UTC()
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	queueLogLock.Lock()
+	defer queueLogLock.Unlock()
+	if queueLog == nil {
+		return os.ErrClosed
+	}
+	if _, err = queueLog.Write(buf); err != nil {
+		return err
+	}
+	if err = queueLog.Sync(); err != nil {
+		return err
+	}
+	applyQueueLog(entry)
+	return nil
+} // func
+
+// applyQueueLog keeps the in-memory list of unfinished messages up to date.  The
+// caller must be holding the lock.
+func applyQueueLog(entry QueueLogEntry) {
+	if entry.Op == LOG_DONE {
+		delete(queuePending, entry.Id)
+		return
+	}
+	// A message keeps its place in line when it moves from inbound to outbound.
+	if prev, ok := queuePending[entry.Id]; ok {
+		entry.Time = prev.Time
+	}
+	queuePending[entry.Id] = entry
+} // func
+
+// sortedPending returns the unfinished messages in the order they were logged.  The
+// caller must be holding the lock.
+func sortedPending() []QueueLogEntry {
+	list := make([]QueueLogEntry, 0, len(queuePending))
+	for _, entry := range queuePending {
+		list = append(list, entry)
+	} // for
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.Before(list[j].Time)
+	})
+	return list
+} // func
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Outbound delivery defaults used when config.json does not override them.
+const (
+	DEFAULT_OUTBOUND_WORKERS = 4
+	DEFAULT_SLACK_TIMEOUT    = 15
+)
+
+// A hookQueue holds the posts for a hook that its worker is waiting on, either for a
+// rate limit slot or for a retry.  The first post is the one being sent, and the rest
+// line up behind it so the hook's posts stay in order.
+type hookQueue struct {
+	hook     string
+	posts    []SlackMessageOut
+	due      time.Time // when the first post can go
+	tries    int       // attempts on the first post so far
+	reserved bool      // the first post already holds a rate limit slot
+}
+
+// outboundWorker delivers the posts on one outbound list.  A hook that has to wait is
+// parked, so the worker can get on with its other hooks in the meantime.
+type outboundWorker struct {
+	lanes   OutboundLanes
+	waiting map[string]*hookQueue
+}
+
+// FinishOutbound deals with the outcome of delivering a message.
+func FinishOutbound(doc SlackMessageOut, delivered bool) {
+	RecordDelivery(doc, delivered)
+	if !delivered {
+		log.Printf("error: Gave up on channel %s after %d attempts", doc.Payload.Channel, len(doc.Attempts))
+		// A notice that can't be delivered stops here.  Reporting it would only
+		// create another notice headed for the same trouble.
+		if doc.IsNotification {
+			return
+		}
+		AddDeadLetter(DeliveryFailure(doc), doc.Key, nil, &doc)
+		return
+	}
+	// Notices never go in the queue log, so there's nothing to mark done.
+	if !doc.IsNotification {
+		LogDone(doc.Id)
+	}
+	log.Printf("sent to channel %s", doc.Payload.Channel)
+} // func
+
+// ReadyOutbound tells the caller if a message is still worth sending.  One that isn't
+// has already been dealt with, unless it only has to wait for the hook's breaker, in
+// which case it also returns how long to hold it.
+func ReadyOutbound(doc SlackMessageOut) (bool, time.Duration) {
+	// Old news isn't worth posting.
+	if IsExpired(doc.Expires) && !doc.IsNotification {
+		ExpireOutbound(doc)
+		return false, 0
+	}
+
+	// Don't waste retries on a hook that has been failing.  Its messages wait until
+	// the breaker lets a probe through, unless Slack has said the hook is gone.
+	ok, wait := AllowDelivery(doc.Hook)
+	if ok {
+		return true, 0
+	}
+	if wait > 0 {
+		SetMessageState(doc.Id, STATE_HELD, "Circuit open for hook")
+		return false, wait
+	}
+	log.Printf("error: Hook is gone for channel %s", doc.Payload.Channel)
+	if !doc.IsNotification {
+		AddDeadLetter("Slack says the hook is gone", doc.Key, nil, &doc)
+	}
+	return false, 0
+} // func
+
+// NewSlackClient builds the HTTP client used to post to Slack.  Every stage of the
+// request has a time limit so a hung connection can't tie up a worker for good.
+func NewSlackClient() *http.Client {
+	timeout := time.Duration(DEFAULT_SLACK_TIMEOUT) * time.Second
+	if appConfig.SlackTimeoutSeconds > 0 {
+		timeout = time.Duration(appConfig.SlackTimeoutSeconds) * time.Second
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   4,
+		},
+	}
+} // func
+
+// RunOutboundWorker delivers the messages on its list one at a time, the most
+// important first.  Since a hook always lands on the same worker, messages of the same
+// priority to a hook stay in order.
+func RunOutboundWorker(lanes OutboundLanes) {
+	w := &outboundWorker{lanes: lanes, waiting: make(map[string]*hookQueue)}
+	for {
+		w.step()
+	} // for
+} // func
+
+// step does the next bit of work.  A parked hook that is due goes first, then a new
+// post, and if there is neither the worker waits for whichever turns up first.
+func (w *outboundWorker) step() {
+	now := time.Now()
+	var next time.Time
+	held := 0
+	for _, q := range w.waiting {
+		if !q.due.After(now) {
+			w.send(q)
+			return
+		}
+		if next.IsZero() || q.due.Before(next) {
+			next = q.due
+		}
+		held += len(q.posts)
+	} // for
+
+	// Parked posts are off the list, so they would get around its limit.  Once there
+	// are a list's worth, new posts stay where they are until a hook is due.
+	if held >= w.lanes.capacity {
+		time.Sleep(next.Sub(now))
+		return
+	}
+
+	doc, ok := w.lanes.TryTake()
+	if !ok {
+		// Caught up, so see if anything was spilled to disk while we were busy.
+		w.lanes.Refill()
+		if next.IsZero() {
+			doc, ok = w.lanes.Take(), true
+		} else {
+			doc, ok = w.lanes.TakeBefore(next)
+		}
+	}
+	if !ok {
+		return
+	}
+	if q, parked := w.waiting[doc.Hook]; parked {
+		q.posts = append(q.posts, doc)
+		return
+	}
+	w.send(&hookQueue{hook: doc.Hook, posts: []SlackMessageOut{doc}})
+} // func
+
+// send moves the hook's first post along.  A new post is checked and given a rate limit
+// slot, and once its slot comes up it is attempted.  Whenever the post has to wait the
+// hook is parked until it is due.
+func (w *outboundWorker) send(q *hookQueue) {
+	doc := &q.posts[0]
+	if !q.reserved {
+		if q.tries == 0 {
+			ready, wait := ReadyOutbound(*doc)
+			if wait > 0 {
+				w.park(q, wait)
+				return
+			}
+			if !ready {
+				w.next(q)
+				return
+			}
+		}
+		// Queue up behind anything else headed for the same hook.
+		if wait := ReserveSlot(*doc); wait > 0 {
+			q.reserved = true
+			w.park(q, wait)
+			return
+		}
+	}
+	q.reserved = false
+	q.tries++
+	delivered, wait := AttemptDelivery(doc, q.tries)
+	if wait > 0 {
+		w.park(q, wait)
+		return
+	}
+	FinishOutbound(*doc, delivered)
+	w.next(q)
+} // func
+
+// next moves the hook on to its next post, if it has one.  That post is due right away
+// and gets its own rate limit slot.
+func (w *outboundWorker) next(q *hookQueue) {
+	q.posts = q.posts[1:]
+	q.tries = 0
+	q.reserved = false
+	if len(q.posts) == 0 {
+		delete(w.waiting, q.hook)
+		return
+	}
+	q.due = time.Time{}
+	w.waiting[q.hook] = q
+} // func
+
+// park sets the hook aside until the wait is over.
+func (w *outboundWorker) park(q *hookQueue, wait time.Duration) {
+	q.due = time.Now().Add(wait)
+	w.waiting[q.hook] = q
+} // func
+
+// ShardFor picks the worker responsible for a hook.
+func ShardFor(hook string) int {
+	h := fnv.New32a()
+	h.Write([]byte(hook))
+	return int(h.Sum32() % uint32(len(OutboundList)))
+} // func
+
+// StartOutboundWorkers spins up a delivery worker for each outbound list.  This needs
+// to happen after the queues are made.
+func StartOutboundWorkers() {
+	slackClient = NewSlackClient()
+	for i := range OutboundList {
+		go OutboundList[i].Feed()
+		go RunOutboundWorker(OutboundList[i])
+	} // for
+	log.Printf("info: Started %d outbound workers.", len(OutboundList))
+} // func